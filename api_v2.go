@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	API_V2_PREFIX = "/v2/"
+
+	ERROR_BAD_REQUEST        = "bad_request"
+	ERROR_UNAUTHORIZED       = "unauthorized"
+	ERROR_NOT_FOUND          = "not_found"
+	ERROR_METHOD_NOT_ALLOWED = "method_not_allowed"
+	ERROR_INTERNAL           = "internal_error"
+)
+
+// apiResponse is the envelope of every v2 response.
+type apiResponse struct {
+	Data       interface{}    `json:"data"`
+	Error      *apiError      `json:"error,omitempty"`
+	Pagination *apiPagination `json:"pagination,omitempty"`
+}
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type apiPagination struct {
+	Page       int    `json:"page,omitempty"`
+	Size       int    `json:"size"`
+	Total      int    `json:"total"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type apiCount struct {
+	Count int `json:"count"`
+}
+
+type apiDeleted struct {
+	PackageId int    `json:"packageId"`
+	Repo      string `json:"repo"`
+}
+
+// apiAdminToken authorizes the v2 requests that change the catalog. They
+// are refused when $PONYSTICKER_ADMIN_TOKEN is not set.
+var apiAdminToken string
+
+func setupAPIV2() {
+	apiAdminToken = os.Getenv("PONYSTICKER_ADMIN_TOKEN")
+	http.HandleFunc(API_V2_PREFIX, apiNotFoundHandler)
+	http.HandleFunc(API_V2_PREFIX+"packages", apiPackagesHandler)
+	http.HandleFunc(API_V2_PREFIX+"packages/", apiPackageHandler)
+	http.HandleFunc(API_V2_PREFIX+"sticker", apiStickerHandler)
+	http.HandleFunc(API_V2_PREFIX+"suggest", apiSuggestHandler)
+	http.HandleFunc(API_V2_PREFIX+"sticker-info", apiStickerLookupHandler)
+	http.HandleFunc(API_V2_PREFIX+"lookup", apiStickerLookupHandler)
+}
+
+func writeAPIResponse(w http.ResponseWriter, status int, res apiResponse) {
+	data, err := json.Marshal(res)
+	if err != nil {
+		logger.Println(err)
+		status = http.StatusInternalServerError
+		data = []byte(`{"data":null,"error":{"code":"` + ERROR_INTERNAL + `","message":"internal server error"}}`)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// writeAPIError is the errorWriter of the v2 API.
+func writeAPIError(w http.ResponseWriter, message string, status int) {
+	var code string
+	switch status {
+	case http.StatusBadRequest:
+		code = ERROR_BAD_REQUEST
+	case http.StatusUnauthorized:
+		code = ERROR_UNAUTHORIZED
+	case http.StatusNotFound:
+		code = ERROR_NOT_FOUND
+	case http.StatusMethodNotAllowed:
+		code = ERROR_METHOD_NOT_ALLOWED
+	default:
+		code = ERROR_INTERNAL
+	}
+
+	// headers meant for the sticker must not describe the error body
+	w.Header().Del("ETag")
+	w.Header().Del("Cache-Control")
+	writeAPIResponse(w, status, apiResponse{Error: &apiError{Code: code, Message: message}})
+}
+
+func checkAPIMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeAPIError(w, "method "+r.Method+" is not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+// checkAPIAdmin accepts a request with "Authorization: Bearer <token>".
+func checkAPIAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if apiAdminToken == "" || !bearer ||
+		subtle.ConstantTimeCompare([]byte(token), []byte(apiAdminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAPIError(w, "admin token is required", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func apiNotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	writeAPIError(w, "no such api", http.StatusNotFound)
+}
+
+// apiPackagesHandler lists or searches packages of one or more repos.
+func apiPackagesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if !checkAPIMethod(w, r, "GET", "HEAD") {
+		return
+	}
+
+	params, err := parsePkgParams(r)
+	if err != nil {
+		writeAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if (params.cursor == nil && params.page < 1) || params.size < 1 {
+		writeAPIError(w, "parameter page and size must be positive", http.StatusBadRequest)
+		return
+	}
+
+	metalist, nextCursor, total, err := findPackages(params)
+	if err != nil {
+		logger.Println(err)
+		writeAPIError(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if total < 0 {
+		total, err = countPackage(params)
+		if err != nil {
+			logger.Println(err)
+			writeAPIError(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	data := make([]json.RawMessage, 0, len(metalist))
+	for _, meta := range metalist {
+		data = append(data, json.RawMessage(meta))
+	}
+	writeAPIResponse(w, http.StatusOK, apiResponse{
+		Data: data,
+		Pagination: &apiPagination{
+			Page:       params.page,
+			Size:       params.size,
+			Total:      total,
+			NextCursor: nextCursor,
+		},
+	})
+}
+
+// apiPackageHandler serves /v2/packages/count and /v2/packages/<id>.
+func apiPackageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	name := strings.TrimPrefix(r.URL.Path, API_V2_PREFIX+"packages/")
+	if name == "count" {
+		apiPackageCountHandler(w, r)
+		return
+	}
+
+	packageId, err := strconv.Atoi(name)
+	if err != nil {
+		writeAPIError(w, "package id must be an integer", http.StatusBadRequest)
+		return
+	}
+
+	if !checkAPIMethod(w, r, "GET", "HEAD", "DELETE") {
+		return
+	}
+	if r.Method == "DELETE" {
+		apiDeletePackageHandler(w, r, packageId)
+		return
+	}
+
+	meta, err := findMeta(checkRepo(packageId), packageId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeAPIError(w, "no such package", http.StatusNotFound)
+		} else {
+			logger.Println(err)
+			writeAPIError(w, "internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	if lang := r.FormValue("lang"); lang != "" {
+		meta, err = localizeMeta(meta, lang)
+		if err != nil {
+			logger.Println(err)
+			writeAPIError(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	writeAPIResponse(w, http.StatusOK, apiResponse{Data: json.RawMessage(meta)})
+}
+
+func apiPackageCountHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAPIMethod(w, r, "GET", "HEAD") {
+		return
+	}
+
+	params, err := parseCountParams(r)
+	if err != nil {
+		writeAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	count, err := countPackage(params)
+	if err != nil {
+		logger.Println(err)
+		writeAPIError(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, apiResponse{Data: apiCount{Count: count}})
+}
+
+func apiDeletePackageHandler(w http.ResponseWriter, r *http.Request, packageId int) {
+	if !checkAPIAdmin(w, r) {
+		return
+	}
+
+	err := deletePackage(packageId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeAPIError(w, "no such package", http.StatusNotFound)
+		} else {
+			logger.Println("delete", packageId, "err:", err)
+			writeAPIError(w, "internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	logger.Println("delete", packageId)
+	writeAPIResponse(w, http.StatusOK, apiResponse{Data: apiDeleted{PackageId: packageId, Repo: checkRepo(packageId)}})
+}
+
+// apiStickerHandler serves the same image as /sticker, only errors are
+// reported in the v2 envelope.
+func apiStickerHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if !checkAPIMethod(w, r, "GET", "HEAD") {
+		return
+	}
+	serveSticker(w, r, writeAPIError)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+)
+
+const (
+	CRAWL_NOT_FOUND = "not_found"
+	CRAWL_FAILED    = "failed"
+	// CRAWL_DELETED ids were deleted on purpose and are not downloaded
+	// again until undelete clears the mark
+	CRAWL_DELETED = "deleted"
+
+	// CRAWL_CHECKPOINT_INTERVAL is how many ids are completed between
+	// saves of the progress of an update.
+	CRAWL_CHECKPOINT_INTERVAL = 100
+)
+
+// crawlProgress tracks the ids of an update completed in a row from begin.
+// Workers finish out of order, so the ids completed ahead are kept until
+// the gap before them is filled.
+type crawlProgress struct {
+	lock  sync.Mutex
+	begin int
+	end   int
+	// next is the first id that is not completed
+	next  int
+	saved int
+	ahead map[int]bool
+}
+
+// loadCrawlProgress resumes from the checkpoint of the same range unless
+// restart is set.
+func loadCrawlProgress(begin, end int, restart bool) (*crawlProgress, error) {
+	progress := &crawlProgress{begin: begin, end: end, next: begin, saved: begin, ahead: make(map[int]bool)}
+	if restart {
+		return progress, nil
+	}
+
+	stickerDBLock.Lock()
+	defer stickerDBLock.Unlock()
+
+	var lastId int
+	err := stickerDB.QueryRow("SELECT lastId FROM crawl_state WHERE begin=? AND end=?", begin, end).Scan(&lastId)
+	if err == sql.ErrNoRows {
+		return progress, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	progress.next = lastId + 1
+	progress.saved = progress.next
+	return progress, nil
+}
+
+func (self *crawlProgress) complete(id int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.ahead[id] = true
+	for self.ahead[self.next] {
+		delete(self.ahead, self.next)
+		self.next++
+	}
+
+	if self.next-self.saved >= CRAWL_CHECKPOINT_INTERVAL {
+		err := self.save()
+		if err != nil {
+			logger.Println("save crawl state err:", err)
+		}
+	}
+}
+
+func (self *crawlProgress) save() error {
+	stickerDBLock.Lock()
+	defer stickerDBLock.Unlock()
+
+	_, err := stickerDB.Exec(`INSERT OR REPLACE INTO crawl_state (begin, end, lastId, updatedAt)
+							  VALUES (?, ?, ?, ?);`,
+		self.begin, self.end, self.next-1, time.Now().Unix())
+	if err == nil {
+		self.saved = self.next
+	}
+	return err
+}
+
+// finish drops the checkpoint of a completed update, so that running it
+// again starts over.
+func (self *crawlProgress) finish() error {
+	stickerDBLock.Lock()
+	defer stickerDBLock.Unlock()
+
+	_, err := stickerDB.Exec(`DELETE FROM crawl_state WHERE begin=? AND end=?;`, self.begin, self.end)
+	return err
+}
+
+// skipReason tells why the crawler leaves an id alone: it was deleted, or
+// it was not found within recheck. It is empty when the id is crawled.
+func skipReason(id int, recheck time.Duration) (string, error) {
+	stickerDBLock.Lock()
+	defer stickerDBLock.Unlock()
+
+	var status string
+	var checkedAt int64
+	err := stickerDB.QueryRow("SELECT status, checkedAt FROM crawl_ids WHERE packageId=?", id).Scan(&status, &checkedAt)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case status == CRAWL_DELETED:
+		return "deleted", nil
+	case status == CRAWL_NOT_FOUND && time.Since(time.Unix(checkedAt, 0)) < recheck:
+		return "not found recently", nil
+	}
+	return "", nil
+}
+
+// recordCrawl keeps the ids that were not found or failed with the
+// history of their failures, and forgets them once they are inserted.
+func recordCrawl(id int, crawlErr error) error {
+	stickerDBLock.Lock()
+	defer stickerDBLock.Unlock()
+
+	tx, err := stickerDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	switch {
+	case crawlErr == nil:
+		_, err = tx.Exec(`DELETE FROM crawl_ids WHERE packageId=?;`, id)
+		if err == nil {
+			_, err = tx.Exec(`DELETE FROM crawl_failures WHERE packageId=?;`, id)
+		}
+	case crawlErr == ErrNotFound:
+		_, err = tx.Exec(`INSERT OR REPLACE INTO crawl_ids (packageId, status, checkedAt)
+						  VALUES (?, ?, ?);`,
+			id, CRAWL_NOT_FOUND, now)
+	default:
+		_, err = tx.Exec(`INSERT OR REPLACE INTO crawl_ids (packageId, status, checkedAt)
+						  VALUES (?, ?, ?);`,
+			id, CRAWL_FAILED, now)
+		if err == nil {
+			stage, message := describeFailure(crawlErr)
+			_, err = tx.Exec(`INSERT INTO crawl_failures (packageId, stage, error, failedAt)
+							  VALUES (?, ?, ?, ?);`,
+				id, stage, message, now)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
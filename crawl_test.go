@@ -0,0 +1,138 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// writeMirrorMeta puts the productInfo.meta of a package into a local
+// mirror for DirectorySource.
+func writeMirrorMeta(t *testing.T, root string, id int) {
+	directory := path.Join(root, fmt.Sprint(id), "android")
+	err := os.MkdirAll(directory, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := fmt.Sprintf(`{"packageId":%d,"title":{"en":"Pony %d"},"author":{"en":"Pony"},"stickers":[]}`, id, id)
+	err = ioutil.WriteFile(path.Join(directory, "productInfo.meta"), []byte(meta), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCrawlProgressComplete(t *testing.T) {
+	progress := &crawlProgress{begin: 10, end: 20, next: 10, saved: 10, ahead: make(map[int]bool)}
+
+	progress.complete(12)
+	progress.complete(11)
+	if progress.next != 10 {
+		t.Errorf("next = %d before 10 is completed, want 10", progress.next)
+	}
+
+	progress.complete(10)
+	if progress.next != 13 || len(progress.ahead) != 0 {
+		t.Errorf("next = %d with %v ahead, want 13 with none", progress.next, progress.ahead)
+	}
+}
+
+func TestCrawlCheckpoint(t *testing.T) {
+	begin, end := 800000, 801000
+
+	progress, err := loadCrawlProgress(begin, end, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.next != begin {
+		t.Fatalf("next = %d without a checkpoint, want %d", progress.next, begin)
+	}
+
+	// the checkpoint is saved every CRAWL_CHECKPOINT_INTERVAL ids
+	for id := begin; id < begin+CRAWL_CHECKPOINT_INTERVAL+10; id++ {
+		progress.complete(id)
+	}
+
+	resumed, err := loadCrawlProgress(begin, end, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.next != begin+CRAWL_CHECKPOINT_INTERVAL {
+		t.Errorf("resumed at %d, want %d", resumed.next, begin+CRAWL_CHECKPOINT_INTERVAL)
+	}
+
+	restarted, err := loadCrawlProgress(begin, end, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restarted.next != begin {
+		t.Errorf("restarted at %d, want %d", restarted.next, begin)
+	}
+
+	err = progress.finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	finished, err := loadCrawlProgress(begin, end, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finished.next != begin {
+		t.Errorf("next = %d after finish, want %d", finished.next, begin)
+	}
+}
+
+func TestUpdateResumesFromCheckpoint(t *testing.T) {
+	root, err := ioutil.TempDir("", "ponysticker-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// 700004 is not in the mirror
+	begin, end := 700000, 700005
+	for id := begin; id < end-1; id++ {
+		writeMirrorMeta(t, root, id)
+	}
+
+	defer func(source StickerSource) { stickerSource = source }(stickerSource)
+	stickerSource = NewDirectorySource(root)
+
+	// an earlier update stopped after 700001
+	progress = &crawlProgress{begin: begin, end: end, next: begin + 2}
+	err = progress.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Update(begin, end, updateOptions{workers: 2})
+
+	for id := begin; id < end-1; id++ {
+		_, err := findMeta("official", id)
+		switch {
+		case id < begin+2 && err != sql.ErrNoRows:
+			t.Errorf("package %d before the checkpoint err: %v, want no rows", id, err)
+		case id >= begin+2 && err != nil:
+			t.Errorf("package %d after the checkpoint err: %v", id, err)
+		}
+	}
+
+	reason, err := skipReason(end-1, time.Hour)
+	if err != nil || reason != "not found recently" {
+		t.Errorf("skipReason of the missing package = %q, %v", reason, err)
+	}
+	if reason, _ := skipReason(end-1, 0); reason != "" {
+		t.Errorf("skipReason with no recheck = %q, want none", reason)
+	}
+
+	resumed, err := loadCrawlProgress(begin, end, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.next != begin {
+		t.Errorf("the checkpoint of a finished update is at %d, want it cleared", resumed.next)
+	}
+}
@@ -48,9 +48,9 @@ func create(id, begin int) {
 	for _, file := range files {
 		ext := filepath.Ext(file.Name())
 		switch ext {
-		case ".jpg":
+		case ".jpg", ".png":
 			oldpath := path.Join(dirPath, file.Name())
-			newpath := path.Join(dirPath, fmt.Sprint(count, ".jpg"))
+			newpath := path.Join(dirPath, fmt.Sprint(count, ext))
 			err = os.Rename(oldpath, newpath)
 			if err != nil {
 				logger.Println(err)
@@ -88,6 +88,7 @@ func create(id, begin int) {
 			}
 
 			pngBuffer, err := pngFileToJpeg(oldFile)
+			oldFile.Close()
 			if err != nil {
 				logger.Println(err)
 				return
@@ -106,7 +107,8 @@ func create(id, begin int) {
 				return
 			}
 
-			err = os.Remove(oldpath)
+			// keep the original png for clients that need transparency
+			err = os.Rename(oldpath, path.Join(dirPath, fmt.Sprint(begin-count, ".png")))
 			if err != nil {
 				logger.Println(err)
 				return
@@ -201,7 +203,11 @@ func create(id, begin int) {
 		return
 	}
 
-	insert(id)
+	_, err = insert(id)
+	if err != nil {
+		logger.Println(err)
+		return
+	}
 	fmt.Println("complete")
 
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var errCursorFormat = errors.New("parameter cursor format error")
+
+// pkgCursor points just after the last package of a page. It follows the
+// (date, packageId) index so paging stays stable while update inserts rows.
+type pkgCursor struct {
+	order     string
+	date      int64
+	packageId int64
+}
+
+func parsePkgCursor(text, order string) (*pkgCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(text)
+	if err != nil {
+		return nil, errCursorFormat
+	}
+
+	fields := strings.Split(string(data), ":")
+	if len(fields) != 3 || fields[0] != order {
+		return nil, errCursorFormat
+	}
+
+	var cursor pkgCursor
+	cursor.order = fields[0]
+	cursor.date, err = strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, errCursorFormat
+	}
+	cursor.packageId, err = strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, errCursorFormat
+	}
+	return &cursor, nil
+}
+
+func (self *pkgCursor) String() string {
+	text := fmt.Sprintf("%s:%d:%d", self.order, self.date, self.packageId)
+	return base64.RawURLEncoding.EncodeToString([]byte(text))
+}
+
+// condition returns the WHERE clause selecting the rows after the cursor.
+func (self *pkgCursor) condition(repo string) (string, []interface{}) {
+	if self.order == "date" {
+		return "(" + repo + ".date>? OR (" + repo + ".date=? AND " + repo + ".packageId>?))",
+			[]interface{}{self.date, self.date, self.packageId}
+	}
+	return repo + ".packageId>?", []interface{}{self.packageId}
+}
+
+// orderBy returns the ORDER BY clause matching the cursor condition. It
+// refers to the result columns so that it also applies to a UNION.
+func orderBy(order string) string {
+	if order == "date" {
+		return "date, packageId"
+	}
+	return "packageId"
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestPkgCursorRoundTrip(t *testing.T) {
+	cursors := []pkgCursor{
+		{order: "date", date: 1420070400, packageId: 1000001},
+		{order: "date", date: 0, packageId: 1},
+		{order: "packageId", date: 0, packageId: 42},
+	}
+
+	for _, cursor := range cursors {
+		got, err := parsePkgCursor(cursor.String(), cursor.order)
+		if err != nil {
+			t.Errorf("parsePkgCursor(%+v) err: %v", cursor, err)
+			continue
+		}
+		if *got != cursor {
+			t.Errorf("parsePkgCursor(%+v) = %+v", cursor, *got)
+		}
+	}
+}
+
+func TestParsePkgCursorError(t *testing.T) {
+	encode := func(text string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(text))
+	}
+	tests := []struct {
+		text  string
+		order string
+	}{
+		{"", "date"},
+		{"not base64!", "date"},
+		{encode("date:1:2"), "packageId"},
+		{encode("date:1"), "date"},
+		{encode("date:1:2:3"), "date"},
+		{encode("date:x:2"), "date"},
+		{encode("date:1:y"), "date"},
+	}
+
+	for _, test := range tests {
+		_, err := parsePkgCursor(test.text, test.order)
+		if err != errCursorFormat {
+			t.Errorf("parsePkgCursor(%q, %q) err: %v, want %v", test.text, test.order, err, errCursorFormat)
+		}
+	}
+}
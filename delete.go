@@ -0,0 +1,200 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+func Delete(id int) {
+	logger.Println("delete", id)
+	setupTable()
+	err := deletePackage(id)
+	if err == sql.ErrNoRows {
+		fmt.Println(id, "does not exist")
+		return
+	}
+	if err != nil {
+		logger.Println("delete", id, "err:", err)
+	}
+}
+
+func Hide(id int, hidden bool) {
+	logger.Println("hide", id, hidden)
+	setupTable()
+	err := hidePackage(id, hidden)
+	if err == sql.ErrNoRows {
+		fmt.Println(id, "does not exist")
+		return
+	}
+	if err != nil {
+		logger.Println("hide", id, "err:", err)
+	}
+}
+
+// Undelete clears the deleted mark of an id and downloads the package
+// again, since delete removed its files.
+func Undelete(id int) {
+	logger.Println("undelete", id)
+	setupTable()
+	err := undeletePackage(id)
+	if err == sql.ErrNoRows {
+		fmt.Println(id, "is not deleted")
+		return
+	}
+	if err != nil {
+		logger.Println("undelete", id, "err:", err)
+		return
+	}
+
+	if checkRepo(id) == "custom" {
+		// custom packages are not on LINE, create them again instead
+		fmt.Println(id, "can be created again")
+		return
+	}
+
+	err = downlodAndInsert(id)
+	switch {
+	case err == ErrNotFound:
+		fmt.Println(id, " does not exist")
+	case err != nil:
+		logger.Println("undelete", id, "err:", err)
+	}
+	err = recordCrawl(id, err)
+	if err != nil {
+		logger.Println("record crawl state", id, "err:", err)
+	}
+}
+
+// undeletePackage removes the mark that keeps update from downloading a
+// deleted package.
+func undeletePackage(id int) error {
+	stickerDBLock.Lock()
+	defer stickerDBLock.Unlock()
+
+	result, err := stickerDB.Exec(`DELETE FROM crawl_ids WHERE packageId=? AND status=?;`, id, CRAWL_DELETED)
+	if err != nil {
+		return err
+	}
+	cleared, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if cleared == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// deletePackage removes the rows, search rows and stickers of a package
+// and its directory, and marks the id deleted for the crawler. The
+// directory is moved aside before the commit so that a failed commit can
+// put it back.
+func deletePackage(id int) error {
+	repo := checkRepo(id)
+	if repo == "" {
+		return sql.ErrNoRows
+	}
+
+	stickerDBLock.Lock()
+	defer stickerDBLock.Unlock()
+
+	tx, err := stickerDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM `+repo+` WHERE packageId=?;`, id)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+
+	err = unindexPackage(tx, repo, id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM stickers WHERE packageId=?;`, id)
+	if err != nil {
+		return err
+	}
+
+	// keep update from downloading the package again until undelete
+	_, err = tx.Exec(`INSERT OR REPLACE INTO crawl_ids (packageId, status, checkedAt)
+					  VALUES (?, ?, ?);`,
+		id, CRAWL_DELETED, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	err = updateRepoCountTx(tx, repo)
+	if err != nil {
+		return err
+	}
+
+	packageDirectory := path.Join(stickerDirectory, fmt.Sprint(id))
+	trashDirectory := packageDirectory + ".deleted"
+	err = os.Rename(packageDirectory, trashDirectory)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	moved := err == nil
+
+	err = tx.Commit()
+	if err != nil {
+		if moved {
+			os.Rename(trashDirectory, packageDirectory)
+		}
+		return err
+	}
+
+	if moved {
+		return os.RemoveAll(trashDirectory)
+	}
+	return nil
+}
+
+// hidePackage keeps a package out of listing and search, or brings it
+// back, without deleting it.
+func hidePackage(id int, hidden bool) error {
+	repo := checkRepo(id)
+	if repo == "" {
+		return sql.ErrNoRows
+	}
+
+	stickerDBLock.Lock()
+	defer stickerDBLock.Unlock()
+
+	tx, err := stickerDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE `+repo+` SET hidden=? WHERE packageId=?;`, hidden, id)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+
+	err = updateRepoCountTx(tx, repo)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// The stages of fetching and inserting a package a failure is recorded at.
+const (
+	STAGE_FETCH   = "fetch"
+	STAGE_UNZIP   = "unzip"
+	STAGE_META    = "meta"
+	STAGE_IMAGE   = "image"
+	STAGE_INSERT  = "insert"
+	STAGE_UNKNOWN = "unknown"
+
+	DEFAULT_MIN_FAILURES = 2
+)
+
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (self *stageError) Error() string {
+	return self.stage + ": " + self.err.Error()
+}
+
+// failAt tags err with the stage it happened at. ErrNotFound is not a
+// failure and is returned as it is, so are errors already tagged.
+func failAt(stage string, err error) error {
+	if err == nil || err == ErrNotFound {
+		return err
+	}
+	if _, ok := err.(*stageError); ok {
+		return err
+	}
+	return &stageError{stage: stage, err: err}
+}
+
+// describeFailure returns the stage of err and its message without it.
+func describeFailure(err error) (string, string) {
+	if stageErr, ok := err.(*stageError); ok {
+		return stageErr.stage, stageErr.err.Error()
+	}
+	return STAGE_UNKNOWN, err.Error()
+}
+
+// RetryFailed processes the ids whose last update failed again.
+func RetryFailed() {
+	logger.Println("retry failed")
+	setupTable()
+
+	failedIds, err := findFailedIds()
+	if err != nil {
+		logger.Println("query failed ids err:", err)
+		return
+	}
+
+	for _, id := range failedIds {
+		err = downlodAndInsert(id)
+		switch {
+		case err == ErrNotFound:
+			fmt.Println(id, " does not exist")
+		case err != nil:
+			logger.Println("retry", id, "err:", err)
+		}
+		err = recordCrawl(id, err)
+		if err != nil {
+			logger.Println("record crawl state", id, "err:", err)
+		}
+	}
+}
+
+func findFailedIds() ([]int, error) {
+	stickerDBLock.Lock()
+	defer stickerDBLock.Unlock()
+
+	rows, err := stickerDB.Query("SELECT packageId FROM crawl_ids WHERE status=? ORDER BY packageId", CRAWL_FAILED)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	failedIds := make([]int, 0)
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		failedIds = append(failedIds, id)
+	}
+	return failedIds, rows.Err()
+}
+
+// ReportFailures prints the ids that failed at least minFailures times
+// and are not inserted yet, with their last failure.
+func ReportFailures(minFailures int) {
+	setupTable()
+
+	stickerDBLock.Lock()
+	defer stickerDBLock.Unlock()
+
+	// with MAX, sqlite takes stage and error from the row of the last failure
+	rows, err := stickerDB.Query(`SELECT packageId, COUNT(*), stage, error, MAX(failedAt)
+								  FROM crawl_failures
+								  GROUP BY packageId HAVING COUNT(*)>=?
+								  ORDER BY COUNT(*) DESC, packageId`, minFailures)
+	if err != nil {
+		logger.Println("query failures err:", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, count int
+		var stage, message string
+		var failedAt int64
+		err = rows.Scan(&id, &count, &stage, &message, &failedAt)
+		if err != nil {
+			logger.Println("query failures err:", err)
+			return
+		}
+		fmt.Printf("%d\t%d failures\tlast %s\t%s\t%s\n",
+			id, count, time.Unix(failedAt, 0).Format(time.RFC3339), stage, message)
+	}
+	err = rows.Err()
+	if err != nil {
+		logger.Println("query failures err:", err)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/carylorrk/resize"
+	"github.com/chai2010/webp"
+)
+
+const (
+	CACHE_DIRECTORY     = "cache"
+	ANIMATION_DIRECTORY = "animation"
+	SOUND_DIRECTORY     = "sound"
+	MAX_STICKER_SIZE    = 1024
+	// MAX_CACHED_VARIANTS is how many generated images a package keeps,
+	// the oldest are removed first.
+	MAX_CACHED_VARIANTS = 256
+	CACHE_TEMP_PREFIX   = "tmp"
+)
+
+// variantSizes are the widths and heights images are generated in, so
+// clients cannot fill the cache with a variant for every pixel.
+var variantSizes = []uint{32, 64, 96, 128, 192, 256, 384, 512, 768, MAX_STICKER_SIZE}
+
+// sizePresets maps the size parameter of /sticker to a bounding box.
+// Zero keeps the original dimension.
+var sizePresets = map[string][2]uint{
+	"thumb": {96, 96},
+	"full":  {0, 0},
+}
+
+func isVariantSize(size uint) bool {
+	for _, variantSize := range variantSizes {
+		if size == variantSize {
+			return true
+		}
+	}
+	return false
+}
+
+// variantSizesText lists variantSizes for the documentation and errors.
+func variantSizesText() string {
+	sizes := make([]string, 0, len(variantSizes))
+	for _, size := range variantSizes {
+		sizes = append(sizes, fmt.Sprint(size))
+	}
+	return strings.Join(sizes, "|")
+}
+
+// stickerVariant returns the path of the sticker in the requested encoding
+// and size. Anything other than the stored jpg and png is generated on the
+// first request and cached under the package directory.
+func stickerVariant(packageDirectory, sticker, extension string, width, height uint) (string, error) {
+	if width == 0 && height == 0 && extension == IMAGE_EXTENSION {
+		return path.Join(packageDirectory, sticker+extension), nil
+	}
+
+	// packages stored before the png was kept only have the jpg, their png
+	// and webp are generated from it
+	pngPath := path.Join(packageDirectory, sticker+PNG_EXTENSION)
+	_, err := os.Stat(pngPath)
+	hasPNG := err == nil
+	if width == 0 && height == 0 && extension == PNG_EXTENSION && hasPNG {
+		return pngPath, nil
+	}
+
+	name := sticker + extension
+	if width != 0 || height != 0 {
+		name = fmt.Sprintf("%s_%dx%d%s", sticker, width, height, extension)
+	}
+	cachePath := path.Join(packageDirectory, CACHE_DIRECTORY, name)
+	if _, err := os.Stat(cachePath); err == nil {
+		return cachePath, nil
+	}
+
+	// the flattened jpg is resized for jpg so the result looks the same as
+	// before, png and webp come from the original png to keep the alpha
+	sourcePath := pngPath
+	if extension == IMAGE_EXTENSION || !hasPNG {
+		sourcePath = path.Join(packageDirectory, sticker+IMAGE_EXTENSION)
+	}
+	sourceFile, err := os.Open(sourcePath)
+	if err != nil {
+		return "", err
+	}
+	defer sourceFile.Close()
+
+	img, _, err := image.Decode(sourceFile)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case width != 0 && height != 0:
+		img = resize.Thumbnail(width, height, img, resize.Lanczos3)
+	case width != 0 || height != 0:
+		img = resize.Resize(width, height, img, resize.Lanczos3)
+	}
+
+	err = writeCache(cachePath, func(w io.Writer) error {
+		switch extension {
+		case PNG_EXTENSION:
+			return png.Encode(w, img)
+		case WEBP_EXTENSION:
+			return webp.Encode(w, img, &webp.Options{Lossless: true, Exact: true})
+		}
+		return jpeg.Encode(w, img, nil)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	err = trimCache(path.Dir(cachePath))
+	if err != nil {
+		logger.Println("trim cache err:", err)
+	}
+	return cachePath, nil
+}
+
+// trimCache removes the oldest images of a cache directory over
+// MAX_CACHED_VARIANTS.
+func trimCache(cacheDirectory string) error {
+	entries, err := ioutil.ReadDir(cacheDirectory)
+	if err != nil {
+		return err
+	}
+
+	// images still being written by writeCache are left alone
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, info := range entries {
+		if !strings.HasPrefix(info.Name(), CACHE_TEMP_PREFIX) {
+			infos = append(infos, info)
+		}
+	}
+	if len(infos) <= MAX_CACHED_VARIANTS {
+		return nil
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+	for _, info := range infos[:len(infos)-MAX_CACHED_VARIANTS] {
+		err = os.Remove(path.Join(cacheDirectory, info.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCache writes to a temporary file first so that concurrent requests
+// never serve a half written image.
+func writeCache(cachePath string, encode func(w io.Writer) error) error {
+	err := os.MkdirAll(path.Dir(cachePath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile(path.Dir(cachePath), CACHE_TEMP_PREFIX)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	err = encode(tempFile)
+	if err != nil {
+		tempFile.Close()
+		return err
+	}
+
+	err = tempFile.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), cachePath)
+}
+
+func clearStickerCache(id int) error {
+	return os.RemoveAll(path.Join(stickerDirectory, fmt.Sprint(id), CACHE_DIRECTORY))
+}
@@ -1,102 +1,223 @@
 package main
 
 import (
-	"bytes"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"os"
 	"path"
+	"sort"
+	"strings"
 	"time"
 )
 
+// insertStatus tells what insert did to the package.
+type insertStatus int
+
+const (
+	PACKAGE_NEW insertStatus = iota
+	PACKAGE_CHANGED
+	PACKAGE_UNCHANGED
+)
+
+func (self insertStatus) String() string {
+	switch self {
+	case PACKAGE_NEW:
+		return "new"
+	case PACKAGE_CHANGED:
+		return "changed"
+	}
+	return "unchanged"
+}
+
 func Insert(id int) {
 	logger.Println("insert", id)
 	setupTable()
-	insert(id)
+	status, err := insert(id)
+	if err != nil {
+		logger.Println("insert", id, "err:", err)
+		return
+	}
+	fmt.Println("package", id, status)
+
+	// the id is in the database now, update has no reason to skip it
+	err = recordCrawl(id, nil)
+	if err != nil {
+		logger.Println("record crawl state", id, "err:", err)
+	}
 }
 
-func insert(id int) {
-	metaPath := path.Join(stickerDirectory, fmt.Sprint(id), "productInfo.meta")
-	metaFile, err := os.Open(metaPath)
+// insert adds the package or replaces its meta when it is already there.
+// The original date is kept, updatedAt records the last change and
+// checkedAt the last time the meta was compared. The search rows and
+// columns are rebuilt either way, so running it twice leaves exactly one
+// set of them.
+func insert(id int) (insertStatus, error) {
+	repo := checkRepo(id)
+	if repo == "" {
+		return PACKAGE_UNCHANGED, fmt.Errorf("cannot check repo %d", id)
+	}
+
+	err := clearStickerCache(id)
 	if err != nil {
-		logger.Println(err)
-		return
+		return PACKAGE_UNCHANGED, err
 	}
-	defer metaFile.Close()
 
-	metaData, err := ioutil.ReadAll(metaFile)
+	metaPath := path.Join(stickerDirectory, fmt.Sprint(id), "productInfo.meta")
+	metaData, err := ioutil.ReadFile(metaPath)
 	if err != nil {
-		logger.Println(err)
-		return
+		return PACKAGE_UNCHANGED, err
 	}
 
 	metaText := string(metaData)
 	var meta Meta
 	err = json.Unmarshal(metaData, &meta)
 	if err != nil {
-		logger.Println(err)
-		return
-	}
-
-	var authorBuffer bytes.Buffer
-	for _, author := range meta.Author {
-		_, err = authorBuffer.WriteString(author)
-		if err != nil {
-			logger.Println(err)
-			return
-		}
+		return PACKAGE_UNCHANGED, err
 	}
 
 	stickerDBLock.Lock()
 	defer stickerDBLock.Unlock()
 
-	var titleBuffer bytes.Buffer
-	for _, title := range meta.Title {
-		_, err = titleBuffer.WriteString(title)
-		if err != nil {
-			logger.Println(err)
-			return
-		}
+	tx, err := stickerDB.Begin()
+	if err != nil {
+		return PACKAGE_UNCHANGED, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	var oldMetaText string
+	status := PACKAGE_UNCHANGED
+	err = tx.QueryRow(`SELECT meta FROM `+repo+` WHERE packageId=?`, id).Scan(&oldMetaText)
+	switch {
+	case err == sql.ErrNoRows:
+		status = PACKAGE_NEW
+		_, err = tx.Exec(`INSERT INTO `+repo+` (packageId, meta, date, updatedAt, checkedAt)
+						  VALUES (?, ?, ?, ?, ?);`,
+			id, metaText, now, now, now)
+	case err != nil:
+	case oldMetaText != metaText:
+		status = PACKAGE_CHANGED
+		_, err = tx.Exec(`UPDATE `+repo+` SET meta=?, updatedAt=?, checkedAt=? WHERE packageId=?;`,
+			metaText, now, now, id)
+	default:
+		_, err = tx.Exec(`UPDATE `+repo+` SET checkedAt=? WHERE packageId=?;`, now, id)
+	}
+	if err == nil {
+		err = storePackageColumns(tx, repo, id, &meta)
+	}
+	if err == nil {
+		err = unindexPackage(tx, repo, id)
+	}
+	if err == nil {
+		err = indexPackage(tx, repo, id, &meta)
 	}
+	if err != nil {
+		return PACKAGE_UNCHANGED, err
+	}
+	return status, tx.Commit()
+}
 
-	authorText := transformQueryText(authorBuffer.String())
-	titleText := transformQueryText(titleBuffer.String())
+// storePackageColumns copies the fields of meta that can be filtered or
+// sorted on into the columns of the package and the stickers table.
+func storePackageColumns(tx *sql.Tx, repo string, id int, meta *Meta) error {
+	_, err := tx.Exec(`UPDATE `+repo+` SET title=?, author=?, stickerCount=?, hasAnimation=?, hasSound=?
+					  WHERE packageId=?;`,
+		meta.Title[pickLocale(meta.Title, DEFAULT_LOCALE)],
+		meta.Author[pickLocale(meta.Author, DEFAULT_LOCALE)],
+		len(meta.Stickers), meta.HasAnimation, meta.HasSound, id)
+	if err != nil {
+		return err
+	}
 
-	tx, err := stickerDB.Begin()
+	_, err = tx.Exec(`DELETE FROM stickers WHERE packageId=?;`, id)
 	if err != nil {
-		logger.Println(err)
-		return
+		return err
 	}
 
-	repo := checkRepo(id)
-	if repo == "" {
-		logger.Println("cannot check repo", id)
-		return
+	for position, sticker := range meta.Stickers {
+		_, err = tx.Exec(`INSERT OR IGNORE INTO stickers (packageId, stickerId, position)
+						  VALUES (?, ?, ?);`,
+			id, sticker, position)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LOCALE_DOCIDS is the number of docids each package has in the
+// _locale_fts tables. FTS can only find a row by its docid, so the rows of
+// a package are numbered from packageId*LOCALE_DOCIDS.
+const LOCALE_DOCIDS = 256
+
+// indexPackage adds the search rows of a package: one row with every
+// locale for the plain search and one row per locale for the search
+// scoped to a language. The docid of the _fts row is the packageId.
+func indexPackage(tx *sql.Tx, repo string, id int, meta *Meta) error {
+	locales := metaLocales(meta)
+	if len(locales) > LOCALE_DOCIDS {
+		logger.Println("index", id, "skip", len(locales)-LOCALE_DOCIDS, "locales")
+		locales = locales[:LOCALE_DOCIDS]
 	}
 
-	date := time.Now().Unix()
-	_, err = tx.Exec(`INSERT INTO `+repo+` (packageId, meta, date)
-					  VALUES (?, ?, ?);
-					  INSERT INTO `+repo+"_fts"+` (packageId, title, author)
-					  VALUES (?, ?, ?);`,
-		id, metaText, date,
-		id, titleText, authorText)
+	titles := make([]string, 0, len(locales))
+	authors := make([]string, 0, len(locales))
+	for _, locale := range locales {
+		titles = append(titles, meta.Title[locale])
+		authors = append(authors, meta.Author[locale])
+	}
 
+	_, err := tx.Exec(`INSERT INTO `+repo+"_fts"+` (docid, packageId, title, author)
+					  VALUES (?, ?, ?, ?);`,
+		id, id,
+		transformIndexText(strings.Join(titles, " "), ""),
+		transformIndexText(strings.Join(authors, " "), ""))
 	if err != nil {
-		logger.Println(err)
-		err = tx.Rollback()
+		return err
+	}
+
+	for i, locale := range locales {
+		_, err = tx.Exec(`INSERT INTO `+repo+"_locale_fts"+` (docid, packageId, lang, title, author)
+						  VALUES (?, ?, ?, ?, ?);`,
+			int64(id)*LOCALE_DOCIDS+int64(i), id, locale,
+			transformIndexText(meta.Title[locale], locale),
+			transformIndexText(meta.Author[locale], locale))
 		if err != nil {
-			logger.Println(err)
+			return err
 		}
-		return
 	}
+	return nil
+}
 
-	err = tx.Commit()
+// unindexPackage removes the search rows of a package by their docids, a
+// condition on packageId would scan the whole table.
+func unindexPackage(tx *sql.Tx, repo string, id int) error {
+	_, err := tx.Exec(`DELETE FROM `+repo+"_fts"+` WHERE docid=?;`, id)
 	if err != nil {
-		logger.Println(err)
-		return
+		return err
+	}
+
+	first := int64(id) * LOCALE_DOCIDS
+	_, err = tx.Exec(`DELETE FROM `+repo+"_locale_fts"+` WHERE docid BETWEEN ? AND ?;`,
+		first, first+LOCALE_DOCIDS-1)
+	return err
+}
+
+// metaLocales returns every locale of the title and author in a fixed order.
+func metaLocales(meta *Meta) []string {
+	seen := make(map[string]bool)
+	locales := make([]string, 0, len(meta.Title)+len(meta.Author))
+	for _, names := range []map[string]string{meta.Title, meta.Author} {
+		for locale := range names {
+			if !seen[locale] {
+				seen[locale] = true
+				locales = append(locales, locale)
+			}
+		}
 	}
+	sort.Strings(locales)
+	return locales
 }
 
 func checkRepo(id int) string {
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+const DEFAULT_LOCALE = "en"
+
+// pickLocale chooses the locale of names closest to lang: the same locale,
+// then the same language, then English, then whatever there is.
+func pickLocale(names map[string]string, lang string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	locales := make([]string, 0, len(names))
+	for locale := range names {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+
+	for _, locale := range locales {
+		if strings.EqualFold(locale, lang) {
+			return locale
+		}
+	}
+	for _, locale := range locales {
+		if strings.EqualFold(baseLanguage(locale), baseLanguage(lang)) {
+			return locale
+		}
+	}
+	if _, ok := names[DEFAULT_LOCALE]; ok {
+		return DEFAULT_LOCALE
+	}
+	return locales[0]
+}
+
+// baseLanguage strips the script and region, e.g. zh-Hant to zh.
+func baseLanguage(locale string) string {
+	if i := strings.IndexAny(locale, "-_"); i >= 0 {
+		return locale[:i]
+	}
+	return locale
+}
+
+// localizeMeta adds the title and author in the preferred language to the
+// stored meta, leaving the per-locale maps as they are.
+func localizeMeta(metaText, lang string) (string, error) {
+	var meta Meta
+	err := json.Unmarshal([]byte(metaText), &meta)
+	if err != nil {
+		return "", err
+	}
+
+	titleLocale := pickLocale(meta.Title, lang)
+	authorLocale := pickLocale(meta.Author, lang)
+	metaText, err = prependMember(metaText, "localAuthor", meta.Author[authorLocale])
+	if err != nil {
+		return "", err
+	}
+	metaText, err = prependMember(metaText, "localTitle", meta.Title[titleLocale])
+	if err != nil {
+		return "", err
+	}
+	return prependMember(metaText, "lang", titleLocale)
+}
+
+// prependMember adds a member at the beginning of a JSON object without
+// decoding the rest of it.
+func prependMember(object, name string, value interface{}) (string, error) {
+	object = strings.TrimSpace(object)
+	if !strings.HasPrefix(object, "{") {
+		return object, nil
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	member := `{"` + name + `":` + string(data)
+	if strings.TrimSpace(object[1:]) != "}" {
+		member += ","
+	}
+	return member + object[1:], nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -27,6 +28,7 @@ func init() {
 	setupWorkingDirectory()
 	setupLogger()
 	setupStickerDB()
+	setupStickerSource()
 }
 
 func setupWorkingDirectory() {
@@ -59,9 +61,14 @@ func setupStickerDB() {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(-1)
 	}
-	setupTable()
+
+	// migrate must be able to look at the schema before it changes
+	if len(os.Args) < 2 || os.Args[1] != "migrate" {
+		setupTable()
+	}
 }
 
+// setupTable brings the schema of the sticker database up to date.
 func setupTable() {
 	err := stickerDB.Ping()
 	if err != nil {
@@ -69,66 +76,11 @@ func setupTable() {
 		os.Exit(-1)
 	}
 
-	stickerDBLock.Lock()
-	defer stickerDBLock.Unlock()
-	tx, err := stickerDB.Begin()
-	if err != nil {
-		logger.Println(err)
-		os.Exit(-1)
-	}
-
-	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS official(
-		packageId INTEGER PRIMARY KEY,
-		meta TEXT,
-		date INTEGER);
-		CREATE INDEX IF NOT EXISTS officialidate ON official(date, packageId);
-		CREATE VIRTUAL TABLE IF NOT EXISTS official_fts USING fts4 (
-			packageId INTEGER,
-			title TEXT,
-			author TEXT);
-
-		CREATE TABLE IF NOT EXISTS creator(
-		packageId INTEGER PRIMARY KEY,
-		meta TEXT,
-		date INTEGER);
-		CREATE INDEX IF NOT EXISTS creatoridate ON official(date, packageId);
-		CREATE VIRTUAL TABLE IF NOT EXISTS creator_fts USING fts4 (
-			packageId INTEGER,
-			title TEXT,
-			author TEXT);
-
-		CREATE TABLE IF NOT EXISTS custom(
-		packageId INTEGER PRIMARY KEY,
-		meta TEXT,
-		date INTEGER);
-		CREATE INDEX IF NOT EXISTS customidate ON official(date, packageId);
-		CREATE VIRTUAL TABLE IF NOT EXISTS custom_fts USING fts4 (
-			packageId INTEGER,
-			title TEXT,
-			author TEXT);
-
-		CREATE TABLE IF NOT EXISTS meta(
-			name TEXT PRIMARY KEY,
-			count INTEGER
-		);
-		INSERT OR IGNORE INTO meta(name, count) VALUES ('official', 0);
-		INSERT OR IGNORE INTO meta(name, count) VALUES ('creator', 0);
-		INSERT OR IGNORE INTO meta(name, count) VALUES ('custom', 0);`)
-
+	err = migrate(false)
 	if err != nil {
 		logger.Println(err)
-		err = tx.Rollback()
-		if err != nil {
-			logger.Println(err)
-		}
 		os.Exit(-1)
 	}
-
-	err = tx.Commit()
-	if err != nil {
-		logger.Println(err)
-		os.Exit(1)
-	}
 }
 
 func setupLogger() {
@@ -150,24 +102,67 @@ func main() {
 	}
 	switch os.Args[1] {
 	case "update":
-		if len(os.Args) < 4 {
-			fmt.Println("ponysticker-server update <begin> <end>")
+		flags := flag.NewFlagSet("update", flag.ExitOnError)
+		refresh := flags.Bool("refresh", false, "re-fetch the meta of packages already in the database")
+		olderThan := flags.String("older-than", "", "refresh only packages not checked for this long, e.g. 30d")
+		workers := flags.Int("workers", DEFAULT_WORKERS, "number of packages fetched at the same time")
+		rps := flags.Float64("rps", 0, "requests per second to the upstream, 0 is unlimited")
+		retries := flags.Int("retries", DEFAULT_RETRIES, "times a failed request is tried again")
+		retryStatus := flags.String("retry-status", "", "comma separated http statuses to retry (default 429,500,502,503,504)")
+		recheck := flags.String("recheck", "0", "skip ids not found within this long, e.g. 30d, 0 checks them every time")
+		restart := flags.Bool("restart", false, "start over instead of resuming an interrupted update")
+		flags.Parse(os.Args[2:])
+		if flags.NArg() < 2 {
+			fmt.Println("ponysticker-server update [--refresh [--older-than=<age>]] [--workers=<n>] [--rps=<n>] [--retries=<n>] [--retry-status=<codes>] [--recheck=<age>] [--restart] <begin> <end>")
 			os.Exit(0)
 		}
 
-		begin, err := strconv.Atoi(os.Args[2])
+		begin, err := strconv.Atoi(flags.Arg(0))
 		if err != nil {
 			fmt.Println("begin must be a number.")
 			os.Exit(0)
 		}
 
-		end, err := strconv.Atoi(os.Args[3])
+		end, err := strconv.Atoi(flags.Arg(1))
 		if err != nil {
 			fmt.Println("end must be a number.")
 			os.Exit(0)
 		}
 
-		Update(begin, end)
+		if *workers < 1 || *rps < 0 || *retries < 0 {
+			fmt.Println("workers must be positive, rps and retries must not be negative.")
+			os.Exit(0)
+		}
+
+		options := updateOptions{
+			refresh:       *refresh,
+			workers:       *workers,
+			rps:           *rps,
+			retries:       *retries,
+			retryStatuses: defaultRetryStatuses,
+			restart:       *restart,
+		}
+		options.recheck, err = parseAge(*recheck)
+		if err != nil {
+			fmt.Println("recheck must be a duration like 30d or 12h.")
+			os.Exit(0)
+		}
+		if *retryStatus != "" {
+			options.retryStatuses, err = parseStatuses(*retryStatus)
+			if err != nil {
+				fmt.Println("retry-status must be a comma separated list of http statuses.")
+				os.Exit(0)
+			}
+		}
+		if *olderThan != "" {
+			options.olderThan, err = parseAge(*olderThan)
+			if err != nil {
+				fmt.Println("older-than must be a duration like 30d or 12h.")
+				os.Exit(0)
+			}
+		}
+
+		Update(begin, end, options)
 		UpdateAllCount()
 	case "insert":
 		if len(os.Args) < 3 {
@@ -217,6 +212,45 @@ func main() {
 
 		create(id, begin)
 		updateRepoCount("custom")
+	case "delete", "undelete", "hide", "unhide":
+		if len(os.Args) < 3 {
+			fmt.Println("ponysticker-server " + os.Args[1] + " <id>")
+			os.Exit(0)
+		}
+
+		id, err := strconv.Atoi(os.Args[2])
+		if err != nil {
+			fmt.Println("id must be a number.")
+			os.Exit(0)
+		}
+
+		switch os.Args[1] {
+		case "delete":
+			Delete(id)
+		case "undelete":
+			Undelete(id)
+			UpdateAllCount()
+		default:
+			Hide(id, os.Args[1] == "hide")
+		}
+	case "retry-failed":
+		RetryFailed()
+		UpdateAllCount()
+	case "failures":
+		flags := flag.NewFlagSet("failures", flag.ExitOnError)
+		minFailures := flags.Int("min", DEFAULT_MIN_FAILURES, "list ids that failed at least this many times")
+		flags.Parse(os.Args[2:])
+		ReportFailures(*minFailures)
+	case "reindex":
+		Reindex()
+	case "migrate":
+		dryRun := len(os.Args) >= 3 && os.Args[2] == "--dry-run"
+		if len(os.Args) >= 3 && !dryRun {
+			fmt.Println("ponysticker-server migrate [--dry-run]")
+			os.Exit(0)
+		}
+
+		Migrate(dryRun)
 
 	default:
 		printHelp()
@@ -226,8 +260,16 @@ func main() {
 func printHelp() {
 	fmt.Println("ponysticker-server <command>\n")
 	fmt.Println("commands:")
-	fmt.Println("  update <begin> <end>")
+	fmt.Println("  update [--refresh [--older-than=<age>]] [--workers=<n>] [--rps=<n>] [--retries=<n>] [--retry-status=<codes>] [--recheck=<age>] [--restart] <begin> <end>")
 	fmt.Println("  run [port]")
 	fmt.Println("  insert <id>")
 	fmt.Println("  create <id> <begin>")
+	fmt.Println("  delete <id>")
+	fmt.Println("  undelete <id>")
+	fmt.Println("  hide <id>")
+	fmt.Println("  unhide <id>")
+	fmt.Println("  retry-failed")
+	fmt.Println("  failures [--min=<n>]")
+	fmt.Println("  reindex")
+	fmt.Println("  migrate [--dry-run]")
 }
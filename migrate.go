@@ -0,0 +1,308 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// migration is one versioned change of the schema. statements run first,
+// then apply for changes that need more than SQL. Either may be empty.
+type migration struct {
+	version     int
+	description string
+	statements  string
+	apply       func(tx *sql.Tx) error
+}
+
+// migrations are applied once and in order; the version of the database
+// is kept in PRAGMA user_version. Never edit a released migration, append
+// a new one instead.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create package, search and count tables",
+		statements: `CREATE TABLE IF NOT EXISTS official(
+		packageId INTEGER PRIMARY KEY,
+		meta TEXT,
+		date INTEGER);
+		CREATE INDEX IF NOT EXISTS officialidate ON official(date, packageId);
+		CREATE VIRTUAL TABLE IF NOT EXISTS official_fts USING fts4 (
+			packageId INTEGER,
+			title TEXT,
+			author TEXT);
+
+		CREATE TABLE IF NOT EXISTS creator(
+		packageId INTEGER PRIMARY KEY,
+		meta TEXT,
+		date INTEGER);
+		CREATE INDEX IF NOT EXISTS creatoridate ON official(date, packageId);
+		CREATE VIRTUAL TABLE IF NOT EXISTS creator_fts USING fts4 (
+			packageId INTEGER,
+			title TEXT,
+			author TEXT);
+
+		CREATE TABLE IF NOT EXISTS custom(
+		packageId INTEGER PRIMARY KEY,
+		meta TEXT,
+		date INTEGER);
+		CREATE INDEX IF NOT EXISTS customidate ON official(date, packageId);
+		CREATE VIRTUAL TABLE IF NOT EXISTS custom_fts USING fts4 (
+			packageId INTEGER,
+			title TEXT,
+			author TEXT);
+
+		CREATE TABLE IF NOT EXISTS meta(
+			name TEXT PRIMARY KEY,
+			count INTEGER
+		);
+		INSERT OR IGNORE INTO meta(name, count) VALUES ('official', 0);
+		INSERT OR IGNORE INTO meta(name, count) VALUES ('creator', 0);
+		INSERT OR IGNORE INTO meta(name, count) VALUES ('custom', 0);`,
+	},
+	{
+		version:     2,
+		description: "create the date indexes of creator and custom on their own tables",
+		statements: `DROP INDEX IF EXISTS creatoridate;
+		DROP INDEX IF EXISTS customidate;
+		CREATE INDEX creatoridate ON creator(date, packageId);
+		CREATE INDEX customidate ON custom(date, packageId);`,
+	},
+	{
+		version:     3,
+		description: "create per-locale search tables and rebuild the search rows",
+		// lang is only compared, matching it would find every package of
+		// a locale whose code is a query term. The rebuild also numbers
+		// the search rows by packageId, see indexPackage.
+		statements: `CREATE VIRTUAL TABLE IF NOT EXISTS official_locale_fts USING fts4 (
+			packageId INTEGER,
+			lang TEXT,
+			title TEXT,
+			author TEXT,
+			notindexed=lang);
+		CREATE VIRTUAL TABLE IF NOT EXISTS creator_locale_fts USING fts4 (
+			packageId INTEGER,
+			lang TEXT,
+			title TEXT,
+			author TEXT,
+			notindexed=lang);
+		CREATE VIRTUAL TABLE IF NOT EXISTS custom_locale_fts USING fts4 (
+			packageId INTEGER,
+			lang TEXT,
+			title TEXT,
+			author TEXT,
+			notindexed=lang);`,
+		apply: rebuildAllSearchRows,
+	},
+	{
+		version:     4,
+		description: "add package columns and the stickers table",
+		statements: `ALTER TABLE official ADD COLUMN title TEXT;
+		ALTER TABLE official ADD COLUMN author TEXT;
+		ALTER TABLE official ADD COLUMN stickerCount INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE official ADD COLUMN hasAnimation INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE official ADD COLUMN hasSound INTEGER NOT NULL DEFAULT 0;
+
+		ALTER TABLE creator ADD COLUMN title TEXT;
+		ALTER TABLE creator ADD COLUMN author TEXT;
+		ALTER TABLE creator ADD COLUMN stickerCount INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE creator ADD COLUMN hasAnimation INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE creator ADD COLUMN hasSound INTEGER NOT NULL DEFAULT 0;
+
+		ALTER TABLE custom ADD COLUMN title TEXT;
+		ALTER TABLE custom ADD COLUMN author TEXT;
+		ALTER TABLE custom ADD COLUMN stickerCount INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE custom ADD COLUMN hasAnimation INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE custom ADD COLUMN hasSound INTEGER NOT NULL DEFAULT 0;
+
+		CREATE TABLE stickers(
+			packageId INTEGER,
+			stickerId INTEGER,
+			position INTEGER,
+			PRIMARY KEY(packageId, stickerId));
+		CREATE INDEX stickersid ON stickers(stickerId);`,
+		apply: fillAllPackageColumns,
+	},
+	{
+		version:     5,
+		description: "add the hidden flag of packages",
+		statements: `ALTER TABLE official ADD COLUMN hidden INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE creator ADD COLUMN hidden INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE custom ADD COLUMN hidden INTEGER NOT NULL DEFAULT 0;`,
+	},
+	{
+		version:     6,
+		description: "add the update time of packages",
+		statements: `ALTER TABLE official ADD COLUMN updatedAt INTEGER;
+		UPDATE official SET updatedAt=date;
+		ALTER TABLE creator ADD COLUMN updatedAt INTEGER;
+		UPDATE creator SET updatedAt=date;
+		ALTER TABLE custom ADD COLUMN updatedAt INTEGER;
+		UPDATE custom SET updatedAt=date;`,
+	},
+	{
+		version:     7,
+		description: "add the time the meta of packages was last checked",
+		statements: `ALTER TABLE official ADD COLUMN checkedAt INTEGER;
+		UPDATE official SET checkedAt=updatedAt;
+		ALTER TABLE creator ADD COLUMN checkedAt INTEGER;
+		UPDATE creator SET checkedAt=updatedAt;
+		ALTER TABLE custom ADD COLUMN checkedAt INTEGER;
+		UPDATE custom SET checkedAt=updatedAt;`,
+	},
+	{
+		version:     8,
+		description: "create the tables of the crawl progress",
+		statements: `CREATE TABLE crawl_state(
+			begin INTEGER,
+			end INTEGER,
+			lastId INTEGER,
+			updatedAt INTEGER,
+			PRIMARY KEY(begin, end));
+		CREATE TABLE crawl_ids(
+			packageId INTEGER PRIMARY KEY,
+			status TEXT,
+			checkedAt INTEGER);`,
+	},
+	{
+		version:     9,
+		description: "create the table of crawl failures",
+		statements: `CREATE TABLE crawl_failures(
+			packageId INTEGER,
+			stage TEXT,
+			error TEXT,
+			failedAt INTEGER);
+		CREATE INDEX crawl_failuresid ON crawl_failures(packageId);`,
+	},
+}
+
+func Migrate(dryRun bool) {
+	err := stickerDB.Ping()
+	if err != nil {
+		logger.Println(err)
+		return
+	}
+
+	err = migrate(dryRun)
+	if err != nil {
+		logger.Println(err)
+	}
+}
+
+// migrate applies the pending migrations, each in its own transaction
+// together with the new user_version. dryRun only prints them.
+func migrate(dryRun bool) error {
+	stickerDBLock.Lock()
+	defer stickerDBLock.Unlock()
+
+	var version int
+	err := stickerDB.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		fmt.Println("schema version", version)
+	}
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		if dryRun {
+			fmt.Printf("pending migration %d: %s\n%s\n", m.version, m.description, m.statements)
+			if m.apply != nil {
+				fmt.Println("-- and a data migration in go")
+			}
+			continue
+		}
+
+		logger.Println("migrate to version", m.version, m.description)
+		err = applyMigration(m)
+		if err != nil {
+			return fmt.Errorf("migration %d: %v", m.version, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(m migration) error {
+	tx, err := stickerDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if m.statements != "" {
+		_, err = tx.Exec(m.statements)
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.apply != nil {
+		err = m.apply(tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	// PRAGMA does not take parameters
+	_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", m.version))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func rebuildAllSearchRows(tx *sql.Tx) error {
+	for _, repo := range allRepos {
+		_, err := rebuildSearchRows(tx, repo)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fillAllPackageColumns(tx *sql.Tx) error {
+	for _, repo := range allRepos {
+		err := fillPackageColumns(tx, repo)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fillPackageColumns fills the package columns and stickers of the
+// packages inserted before they existed.
+func fillPackageColumns(tx *sql.Tx, repo string) error {
+	pkgRows, err := tx.Query(`SELECT packageId, meta FROM ` + repo)
+	if err != nil {
+		return err
+	}
+	defer pkgRows.Close()
+
+	for pkgRows.Next() {
+		var id int
+		var metaText string
+		err = pkgRows.Scan(&id, &metaText)
+		if err != nil {
+			return err
+		}
+
+		var meta Meta
+		err = json.Unmarshal([]byte(metaText), &meta)
+		if err != nil {
+			logger.Println("skip", id, "err:", err)
+			continue
+		}
+
+		err = storePackageColumns(tx, repo, id, &meta)
+		if err != nil {
+			return err
+		}
+	}
+	return pkgRows.Err()
+}
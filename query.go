@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+// queryClause is a piece of the q parameter: a word or a quoted phrase,
+// optionally limited to a field with "title:" or "author:" and excluded
+// with a leading "-".
+type queryClause struct {
+	field   string
+	phrase  bool
+	negated bool
+	text    string
+}
+
+var queryFields = []string{"title", "author"}
+
+// parseQuery splits query into alternatives separated by OR, each of them a
+// list of clauses that must all hold.
+func parseQuery(query string) [][]queryClause {
+	alternatives := [][]queryClause{{}}
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+
+		var clause queryClause
+		if runes[i] == '-' {
+			clause.negated = true
+			i++
+		}
+		for _, field := range queryFields {
+			prefix := []rune(field + ":")
+			if len(runes)-i > len(prefix) && strings.EqualFold(string(runes[i:i+len(prefix)]), string(prefix)) {
+				clause.field = field
+				i += len(prefix)
+				break
+			}
+		}
+
+		begin := i
+		if i < len(runes) && runes[i] == '"' {
+			clause.phrase = true
+			begin++
+			i++
+			for i < len(runes) && runes[i] != '"' {
+				i++
+			}
+			clause.text = string(runes[begin:i])
+			// skip the closing quote, a missing one ends the query
+			i++
+		} else {
+			for i < len(runes) && !unicode.IsSpace(runes[i]) {
+				i++
+			}
+			clause.text = string(runes[begin:i])
+		}
+
+		if clause.text == "OR" && !clause.phrase && !clause.negated && clause.field == "" {
+			alternatives = append(alternatives, []queryClause{})
+			continue
+		}
+		last := len(alternatives) - 1
+		alternatives[last] = append(alternatives[last], clause)
+	}
+	return alternatives
+}
+
+// matchExpression parses the query syntax of the q parameter into an FTS
+// expression built only from the terms of transformIndexText, so nothing
+// the client writes reaches FTS as syntax.
+func matchExpression(query, lang string) (string, error) {
+	alternatives := make([]string, 0)
+	for _, clauses := range parseQuery(query) {
+		positives := make([]string, 0, len(clauses))
+		negatives := make([]string, 0)
+		for _, clause := range clauses {
+			fragment := clauseExpression(clause, lang)
+			if fragment == "" {
+				continue
+			}
+			if clause.negated {
+				negatives = append(negatives, fragment)
+			} else {
+				positives = append(positives, fragment)
+			}
+		}
+
+		if len(positives) == 0 {
+			if len(negatives) > 0 {
+				return "", errors.New("parameter q cannot only exclude terms")
+			}
+			continue
+		}
+
+		expression := "(" + strings.Join(positives, " ") + ")"
+		for _, negative := range negatives {
+			expression += " NOT " + negative
+		}
+		alternatives = append(alternatives, expression)
+	}
+
+	if len(alternatives) == 0 {
+		return "", errors.New("parameter q has no term to search")
+	}
+	return strings.Join(alternatives, " OR "), nil
+}
+
+func clauseExpression(clause queryClause, lang string) string {
+	var terms []string
+	if clause.phrase {
+		if phrase := phraseQueryText(clause.text, lang); phrase != "" {
+			terms = []string{phrase}
+		}
+	} else {
+		terms = queryTerms(clause.text, lang)
+	}
+	if len(terms) == 0 {
+		return ""
+	}
+
+	if clause.field != "" {
+		for i, term := range terms {
+			terms[i] = clause.field + ":" + term
+		}
+	}
+	if len(terms) == 1 {
+		return terms[0]
+	}
+	return "(" + strings.Join(terms, " ") + ")"
+}
+
+// queryText drops the syntax from query, keeping the words and phrases
+// that are not excluded. Fuzzy search matches on it.
+func queryText(query string) string {
+	texts := make([]string, 0)
+	for _, clauses := range parseQuery(query) {
+		for _, clause := range clauses {
+			if !clause.negated {
+				texts = append(texts, clause.text)
+			}
+		}
+	}
+	return strings.Join(texts, " ")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  [][]queryClause
+	}{
+		{"", [][]queryClause{{}}},
+		{"cat dog", [][]queryClause{{
+			{text: "cat"},
+			{text: "dog"},
+		}}},
+		{`"brown bear" cat`, [][]queryClause{{
+			{phrase: true, text: "brown bear"},
+			{text: "cat"},
+		}}},
+		{`cat "brown bear`, [][]queryClause{{
+			{text: "cat"},
+			{phrase: true, text: "brown bear"},
+		}}},
+		{"cat -dog", [][]queryClause{{
+			{text: "cat"},
+			{negated: true, text: "dog"},
+		}}},
+		{`title:cat Author:"brown bear" -title:dog`, [][]queryClause{{
+			{field: "title", text: "cat"},
+			{field: "author", phrase: true, text: "brown bear"},
+			{field: "title", negated: true, text: "dog"},
+		}}},
+		{"title:", [][]queryClause{{
+			{text: "title:"},
+		}}},
+		{"cat OR dog bear", [][]queryClause{
+			{{text: "cat"}},
+			{{text: "dog"}, {text: "bear"}},
+		}},
+		{`cat or dog "OR" -OR`, [][]queryClause{{
+			{text: "cat"},
+			{text: "or"},
+			{text: "dog"},
+			{phrase: true, text: "OR"},
+			{negated: true, text: "OR"},
+		}}},
+	}
+
+	for _, test := range tests {
+		got := parseQuery(test.query)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseQuery(%q) = %+v, want %+v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestMatchExpression(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"cat", "(cat)"},
+		{"cat dog", "(cat dog)"},
+		{"brown", "((bro row own))"},
+		{`"brown bear"`, `("bro row own bea ear")`},
+		{`"cat`, `("cat")`},
+		{"cat -dog", "(cat) NOT dog"},
+		{"title:cat author:brown", "(title:cat (author:bro author:row author:own))"},
+		{"cat OR dog", "(cat) OR (dog)"},
+		{"cat OR", "(cat)"},
+		{"cat:dog", "((cat dog))"},
+		{"AND NEAR", "(and (nea ear))"},
+	}
+
+	for _, test := range tests {
+		got, err := matchExpression(test.query, "")
+		if err != nil {
+			t.Errorf("matchExpression(%q) err: %v", test.query, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("matchExpression(%q) = %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestMatchExpressionError(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"-dog", "parameter q cannot only exclude terms"},
+		{"cat OR -dog", "parameter q cannot only exclude terms"},
+		{"", "parameter q has no term to search"},
+		{"OR", "parameter q has no term to search"},
+		{`"" !?`, "parameter q has no term to search"},
+	}
+
+	for _, test := range tests {
+		got, err := matchExpression(test.query, "")
+		if err == nil {
+			t.Errorf("matchExpression(%q) = %q, want error %q", test.query, got, test.want)
+			continue
+		}
+		if err.Error() != test.want {
+			t.Errorf("matchExpression(%q) err: %v, want %q", test.query, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+	"strings"
+)
+
+const (
+	BM25_K1 = 1.2
+	BM25_B  = 0.75
+
+	// FUZZY_MIN_SIMILARITY is the fraction of query terms a package must
+	// match to be a fuzzy result.
+	FUZZY_MIN_SIMILARITY = 0.5
+
+	// RANK_MAX_CANDIDATES bounds the matches of each repo that a fuzzy
+	// query scores.
+	RANK_MAX_CANDIDATES = 5000
+)
+
+// ftsColumnWeights weights the columns of the _fts tables: packageId,
+// title and author. A title hit counts twice an author hit.
+var ftsColumnWeights = []float64{0, 2, 1}
+
+// localeColumnWeights is the same for the _locale_fts tables, which have
+// a lang column before title.
+var localeColumnWeights = []float64{0, 0, 2, 1}
+
+type rankedPackage struct {
+	repo       string
+	packageId  int64
+	date       int64
+	similarity float64
+	score      float64
+}
+
+// rankPackages scores the matches of the query and returns the requested
+// page, ordered by relevance or by the order of params, with the number of
+// matches.
+func rankPackages(params pkgParams) ([]string, int, error) {
+	ranked, err := scorePackages(params)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		switch params.order {
+		case "relevance":
+			if a.similarity != b.similarity {
+				return a.similarity > b.similarity
+			}
+			if a.score != b.score {
+				return a.score > b.score
+			}
+		case "date":
+			if a.date != b.date {
+				return a.date < b.date
+			}
+		}
+		return a.packageId < b.packageId
+	})
+
+	begin := (params.page - 1) * params.size
+	if begin < 0 || begin > len(ranked) {
+		begin = len(ranked)
+	}
+	end := begin + params.size
+	if end > len(ranked) {
+		end = len(ranked)
+	}
+
+	// only the metas of the page are read
+	metalist := make([]string, 0, end-begin)
+	for _, pkg := range ranked[begin:end] {
+		var meta string
+		err = stickerDB.QueryRow("SELECT meta FROM "+pkg.repo+" WHERE packageId=?", pkg.packageId).Scan(&meta)
+		if err != nil {
+			return nil, 0, err
+		}
+		meta, err = decorateMeta(meta, pkg.repo, params)
+		if err != nil {
+			return nil, 0, err
+		}
+		metalist = append(metalist, meta)
+	}
+	return metalist, len(ranked), nil
+}
+
+// scorePackages returns the matches of the query with their bm25 score over
+// the matchinfo of the _fts tables. In fuzzy mode it also returns the
+// fraction of query terms matched and drops the packages below
+// FUZZY_MIN_SIMILARITY. A fuzzy query may match a large part of a repo, so
+// only the newest RANK_MAX_CANDIDATES matches of each repo are scored in
+// fuzzy mode; any other query scores every match.
+func scorePackages(params pkgParams) ([]rankedPackage, error) {
+	tx, err := stickerDB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	weights := ftsColumnWeights
+	if params.queryLang != "" {
+		weights = localeColumnWeights
+	}
+
+	ranked := make([]rankedPackage, 0, params.size)
+	for _, repo := range params.repos {
+		repo_fts, _, _ := matchCondition(repo, params)
+		from, conditions, args := filterConditions(repo, params)
+		limit := ""
+		if params.fuzzy {
+			limit = " ORDER BY " + repo + ".date DESC LIMIT ?"
+			args = append(args, RANK_MAX_CANDIDATES)
+		}
+		pkgRows, err := tx.Query("SELECT "+repo+".packageId, "+repo+".date, "+
+			"matchinfo("+repo_fts+", 'pcnalx') "+
+			"FROM "+from+
+			" WHERE "+strings.Join(conditions, " AND ")+limit,
+			args...)
+		if err != nil {
+			return nil, err
+		}
+
+		for pkgRows.Next() {
+			pkg := rankedPackage{repo: repo}
+			var blob []byte
+			err = pkgRows.Scan(&pkg.packageId, &pkg.date, &blob)
+			if err != nil {
+				pkgRows.Close()
+				return nil, err
+			}
+
+			info := parseMatchinfo(blob)
+			if params.fuzzy {
+				pkg.similarity = info.similarity(weights)
+				if pkg.similarity < FUZZY_MIN_SIMILARITY {
+					continue
+				}
+			}
+			pkg.score = info.bm25(weights)
+			ranked = append(ranked, pkg)
+		}
+		err = pkgRows.Err()
+		pkgRows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ranked, tx.Commit()
+}
+
+// matchinfo is the 'pcnalx' matchinfo of FTS4: phrase count, column count,
+// row count, average tokens of each column, tokens of each column in this
+// row, then for each phrase and column the hits in this row, hits in all
+// rows and rows with a hit.
+type matchinfo struct {
+	phrases  int
+	columns  int
+	rows     float64
+	averages []float64
+	lengths  []float64
+	hits     []float64
+}
+
+// parseMatchinfo decodes the native endian uint32 of the blob. A malformed
+// blob gives a matchinfo without phrases.
+func parseMatchinfo(blob []byte) *matchinfo {
+	values := make([]float64, len(blob)/4)
+	for i := range values {
+		values[i] = float64(binary.NativeEndian.Uint32(blob[i*4:]))
+	}
+	if len(values) < 3 {
+		return &matchinfo{}
+	}
+
+	phrases, columns := int(values[0]), int(values[1])
+	if len(values) < 3+2*columns+3*phrases*columns {
+		return &matchinfo{}
+	}
+	return &matchinfo{
+		phrases:  phrases,
+		columns:  columns,
+		rows:     values[2],
+		averages: values[3 : 3+columns],
+		lengths:  values[3+columns : 3+2*columns],
+		hits:     values[3+2*columns:],
+	}
+}
+
+// hit returns the hits of phrase in column of this row and the number of
+// rows with a hit.
+func (self *matchinfo) hit(phrase, column int) (float64, float64) {
+	x := self.hits[3*(phrase*self.columns+column):]
+	return x[0], x[2]
+}
+
+func (self *matchinfo) bm25(weights []float64) float64 {
+	var score float64
+	for phrase := 0; phrase < self.phrases; phrase++ {
+		for column := 0; column < self.columns && column < len(weights); column++ {
+			if weights[column] == 0 {
+				continue
+			}
+			frequency, documents := self.hit(phrase, column)
+			if frequency == 0 {
+				continue
+			}
+
+			idf := math.Log(1 + (self.rows-documents+0.5)/(documents+0.5))
+			norm := 1 - BM25_B
+			if self.averages[column] > 0 {
+				norm += BM25_B * self.lengths[column] / self.averages[column]
+			}
+			score += weights[column] * idf *
+				frequency * (BM25_K1 + 1) / (frequency + BM25_K1*norm)
+		}
+	}
+	return score
+}
+
+// similarity is the fraction of phrases found in a weighted column.
+func (self *matchinfo) similarity(weights []float64) float64 {
+	if self.phrases == 0 {
+		return 0
+	}
+
+	var matched int
+	for phrase := 0; phrase < self.phrases; phrase++ {
+		for column := 0; column < self.columns && column < len(weights); column++ {
+			if frequency, _ := self.hit(phrase, column); weights[column] != 0 && frequency != 0 {
+				matched++
+				break
+			}
+		}
+	}
+	return float64(matched) / float64(self.phrases)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// matchinfoBlob encodes values the way FTS4 returns matchinfo.
+func matchinfoBlob(values ...uint32) []byte {
+	blob := make([]byte, 4*len(values))
+	for i, value := range values {
+		binary.NativeEndian.PutUint32(blob[i*4:], value)
+	}
+	return blob
+}
+
+// oneColumnMatchinfo is the 'pcnalx' matchinfo of one phrase in one column
+// of 100 rows, 10 of them with a hit.
+func oneColumnMatchinfo(frequency, length uint32) *matchinfo {
+	return parseMatchinfo(matchinfoBlob(1, 1, 100, 8, length, frequency, 20, 10))
+}
+
+func TestParseMatchinfo(t *testing.T) {
+	info := parseMatchinfo(matchinfoBlob(2, 2, 100, 8, 4, 6, 3,
+		1, 20, 10, 0, 5, 4,
+		0, 7, 3, 2, 9, 6))
+	if info.phrases != 2 || info.columns != 2 || info.rows != 100 {
+		t.Fatalf("parseMatchinfo = %+v", info)
+	}
+	if info.averages[1] != 4 || info.lengths[0] != 6 || info.lengths[1] != 3 {
+		t.Errorf("parseMatchinfo averages %v lengths %v", info.averages, info.lengths)
+	}
+	frequency, documents := info.hit(1, 1)
+	if frequency != 2 || documents != 6 {
+		t.Errorf("hit(1, 1) = %v, %v, want 2, 6", frequency, documents)
+	}
+
+	for _, blob := range [][]byte{
+		nil,
+		matchinfoBlob(1, 1),
+		matchinfoBlob(1, 2, 100, 8, 4, 6, 3, 1, 20),
+	} {
+		if info := parseMatchinfo(blob); info.phrases != 0 {
+			t.Errorf("parseMatchinfo(%v) = %+v, want no phrases", blob, info)
+		}
+	}
+}
+
+func TestBM25(t *testing.T) {
+	weights := []float64{1}
+	if score := oneColumnMatchinfo(0, 8).bm25(weights); score != 0 {
+		t.Errorf("bm25 without a hit = %v, want 0", score)
+	}
+	if score := oneColumnMatchinfo(1, 8).bm25([]float64{0}); score != 0 {
+		t.Errorf("bm25 of a column weighted 0 = %v, want 0", score)
+	}
+	if score := (&matchinfo{}).bm25(weights); score != 0 {
+		t.Errorf("bm25 of a malformed matchinfo = %v, want 0", score)
+	}
+
+	once := oneColumnMatchinfo(1, 8).bm25(weights)
+	if once <= 0 {
+		t.Fatalf("bm25 of a hit = %v, want more than 0", once)
+	}
+	if twice := oneColumnMatchinfo(2, 8).bm25(weights); twice <= once {
+		t.Errorf("bm25 of two hits = %v, want more than %v", twice, once)
+	}
+	if short := oneColumnMatchinfo(1, 2).bm25(weights); short <= once {
+		t.Errorf("bm25 of a short column = %v, want more than %v", short, once)
+	}
+	if weighted := oneColumnMatchinfo(1, 8).bm25([]float64{2}); weighted != 2*once {
+		t.Errorf("bm25 weighted 2 = %v, want %v", weighted, 2*once)
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	info := parseMatchinfo(matchinfoBlob(2, 2, 100, 8, 4, 6, 3,
+		1, 20, 10, 0, 5, 4,
+		0, 7, 3, 2, 9, 6))
+	if similarity := info.similarity([]float64{1, 1}); similarity != 1 {
+		t.Errorf("similarity = %v, want 1", similarity)
+	}
+	if similarity := info.similarity([]float64{1, 0}); similarity != 0.5 {
+		t.Errorf("similarity without the second column = %v, want 0.5", similarity)
+	}
+	if similarity := (&matchinfo{}).similarity([]float64{1}); similarity != 0 {
+		t.Errorf("similarity of a malformed matchinfo = %v, want 0", similarity)
+	}
+}
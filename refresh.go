@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// refreshPackage fetches the meta of a package in the database again. The
+// images are downloaded again only when the stickers changed, otherwise
+// only the meta is replaced.
+func refreshPackage(id int) {
+	repo := checkRepo(id)
+	metaContent, err := stickerSource.FetchMeta(id)
+	if err == ErrNotFound {
+		logger.Println("refresh", id, "is gone upstream")
+		return
+	}
+	if err != nil {
+		logger.Println("refresh", id, "err:", err)
+		return
+	}
+	defer metaContent.Close()
+
+	rc, err := changeMeta(metaContent)
+	if err != nil {
+		logger.Println("refresh", id, "err:", err)
+		return
+	}
+	metaData, err := ioutil.ReadAll(rc)
+	if err != nil {
+		logger.Println("refresh", id, "err:", err)
+		return
+	}
+
+	oldMetaText, err := findMeta(repo, id)
+	if err != nil {
+		logger.Println("refresh", id, "err:", err)
+		return
+	}
+
+	var meta, oldMeta Meta
+	err = json.Unmarshal(metaData, &meta)
+	if err == nil {
+		err = json.Unmarshal([]byte(oldMetaText), &oldMeta)
+	}
+	if err != nil {
+		logger.Println("refresh", id, "err:", err)
+		return
+	}
+
+	changes := diffMeta(&oldMeta, &meta)
+	if len(changes) == 0 {
+		fmt.Println("refresh", id, "unchanged")
+		err = touchPackage(repo, id)
+		if err != nil {
+			logger.Println("refresh", id, "err:", err)
+		}
+		return
+	}
+	logger.Println("refresh", id, "changed:", strings.Join(changes, ", "))
+
+	if changedImages(changes) {
+		err = downlodAndInsert(id)
+	} else {
+		err = replaceMeta(id, metaData)
+	}
+	if err != nil {
+		logger.Println("refresh", id, "err:", err)
+	}
+
+	// failures go to the same queue as those of new packages
+	err = recordCrawl(id, err)
+	if err != nil {
+		logger.Println("record crawl state", id, "err:", err)
+	}
+}
+
+// replaceMeta stores the meta of a package whose stickers did not change.
+func replaceMeta(id int, metaData []byte) error {
+	metaPath := path.Join(stickerDirectory, fmt.Sprint(id), "productInfo.meta")
+	err := ioutil.WriteFile(metaPath, metaData, os.ModePerm)
+	if err != nil {
+		return failAt(STAGE_META, err)
+	}
+
+	_, err = insert(id)
+	return failAt(STAGE_INSERT, err)
+}
+
+// diffMeta returns the names of the fields that differ between two metas.
+func diffMeta(oldMeta, meta *Meta) []string {
+	changes := make([]string, 0)
+	if !reflect.DeepEqual(oldMeta.Title, meta.Title) {
+		changes = append(changes, "title")
+	}
+	if !reflect.DeepEqual(oldMeta.Author, meta.Author) {
+		changes = append(changes, "author")
+	}
+	if !reflect.DeepEqual(oldMeta.Stickers, meta.Stickers) {
+		changes = append(changes, "stickers")
+	}
+	if oldMeta.HasAnimation != meta.HasAnimation {
+		changes = append(changes, "hasAnimation")
+	}
+	if oldMeta.HasSound != meta.HasSound {
+		changes = append(changes, "hasSound")
+	}
+	return changes
+}
+
+// changedImages reports whether the changes need the images downloaded
+// again.
+func changedImages(changes []string) bool {
+	for _, change := range changes {
+		if change != "title" && change != "author" {
+			return true
+		}
+	}
+	return false
+}
+
+func touchPackage(repo string, id int) error {
+	stickerDBLock.Lock()
+	defer stickerDBLock.Unlock()
+
+	_, err := stickerDB.Exec(`UPDATE `+repo+` SET checkedAt=? WHERE packageId=?;`, time.Now().Unix(), id)
+	return err
+}
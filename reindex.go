@@ -0,0 +1,84 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+)
+
+func Reindex() {
+	logger.Println("reindex")
+	setupTable()
+	for _, repo := range allRepos {
+		err := reindexRepo(repo)
+		if err != nil {
+			logger.Println("reindex", repo, "err:", err)
+		}
+	}
+}
+
+func reindexRepo(repo string) error {
+	stickerDBLock.Lock()
+	defer stickerDBLock.Unlock()
+
+	tx, err := stickerDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	count, err := rebuildSearchRows(tx, repo)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	logger.Println("reindex", repo, count, "packages")
+	return nil
+}
+
+// rebuildSearchRows rebuilds the search rows of a repo from the stored
+// metas and returns the number of packages indexed.
+func rebuildSearchRows(tx *sql.Tx, repo string) (int, error) {
+	_, err := tx.Exec(`DELETE FROM ` + repo + `_fts;
+					  DELETE FROM ` + repo + `_locale_fts;`)
+	if err != nil {
+		return 0, err
+	}
+
+	pkgRows, err := tx.Query(`SELECT packageId, meta FROM ` + repo)
+	if err != nil {
+		return 0, err
+	}
+	defer pkgRows.Close()
+
+	var count int
+	for pkgRows.Next() {
+		var id int
+		var metaText string
+		err = pkgRows.Scan(&id, &metaText)
+		if err != nil {
+			return 0, err
+		}
+
+		var meta Meta
+		err = json.Unmarshal([]byte(metaText), &meta)
+		if err != nil {
+			logger.Println("skip", id, "err:", err)
+			continue
+		}
+
+		err = indexPackage(tx, repo, id, &meta)
+		if err != nil {
+			return 0, err
+		}
+		count++
+	}
+	err = pkgRows.Err()
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
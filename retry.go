@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_WORKERS  = 10
+	DEFAULT_RETRIES  = 5
+	RETRY_BASE_DELAY = 1 * time.Second
+	RETRY_MAX_DELAY  = 2 * time.Minute
+)
+
+// defaultRetryStatuses are rate limiting and the server errors that are
+// usually transient.
+var defaultRetryStatuses = []int{429, 500, 502, 503, 504}
+
+// rateLimiter spaces requests evenly so that no more than rps start in a
+// second, however many workers share it. A nil rateLimiter does not wait.
+type rateLimiter struct {
+	lock     sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(rps float64) *rateLimiter {
+	if rps <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / rps)}
+}
+
+func (self *rateLimiter) Wait() {
+	if self == nil {
+		return
+	}
+
+	self.lock.Lock()
+	now := time.Now()
+	if self.next.Before(now) {
+		self.next = now
+	}
+	delay := self.next.Sub(now)
+	self.next = self.next.Add(self.interval)
+	self.lock.Unlock()
+
+	time.Sleep(delay)
+}
+
+// retryPolicy decides which failed requests are tried again and how long
+// to wait before that. Transport errors are always retried, responses only
+// when their status is in statuses.
+type retryPolicy struct {
+	retries  int
+	statuses map[int]bool
+}
+
+func newRetryPolicy(retries int, statuses []int) retryPolicy {
+	policy := retryPolicy{retries: retries, statuses: make(map[int]bool)}
+	for _, status := range statuses {
+		policy.statuses[status] = true
+	}
+	return policy
+}
+
+// parseStatuses parses a comma separated list of http statuses.
+func parseStatuses(text string) ([]int, error) {
+	statuses := make([]int, 0)
+	for _, field := range strings.Split(text, ",") {
+		status, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || status < 100 || status > 599 {
+			return nil, fmt.Errorf("%q is not an http status", field)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func (self retryPolicy) retryStatus(status int) bool {
+	return self.statuses[status]
+}
+
+// delay is the exponential backoff of attempt with jitter, or the
+// Retry-After of res, up to RETRY_MAX_DELAY, when the server asks for longer.
+func (self retryPolicy) delay(attempt int, res *http.Response) time.Duration {
+	backoff := RETRY_BASE_DELAY << uint(attempt)
+	if backoff <= 0 || backoff > RETRY_MAX_DELAY {
+		backoff = RETRY_MAX_DELAY
+	}
+	// jitter keeps the workers from retrying in lockstep
+	backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+
+	if res != nil {
+		after := retryAfter(res.Header.Get("Retry-After"))
+		if after > RETRY_MAX_DELAY {
+			after = RETRY_MAX_DELAY
+		}
+		if after > backoff {
+			return after
+		}
+	}
+	return backoff
+}
+
+// retryAfter parses Retry-After given in seconds or as an http date.
+func retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
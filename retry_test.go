@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	policy := newRetryPolicy(DEFAULT_RETRIES, defaultRetryStatuses)
+	tests := []struct {
+		attempt    int
+		retryAfter string
+		min, max   time.Duration
+	}{
+		{0, "", RETRY_BASE_DELAY / 2, RETRY_BASE_DELAY},
+		{3, "", 4 * RETRY_BASE_DELAY, 8 * RETRY_BASE_DELAY},
+		{40, "", RETRY_MAX_DELAY / 2, RETRY_MAX_DELAY},
+		{0, "30", 30 * time.Second, 30 * time.Second},
+		{3, "1", 4 * RETRY_BASE_DELAY, 8 * RETRY_BASE_DELAY},
+		{0, "100000", RETRY_MAX_DELAY, RETRY_MAX_DELAY},
+		{0, "soon", RETRY_BASE_DELAY / 2, RETRY_BASE_DELAY},
+		{0, time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), RETRY_MAX_DELAY, RETRY_MAX_DELAY},
+	}
+
+	for _, test := range tests {
+		res := &http.Response{Header: make(http.Header)}
+		if test.retryAfter != "" {
+			res.Header.Set("Retry-After", test.retryAfter)
+		}
+		for i := 0; i < 20; i++ {
+			delay := policy.delay(test.attempt, res)
+			if delay < test.min || delay > test.max {
+				t.Errorf("delay(%d) with Retry-After %q = %v, want from %v to %v",
+					test.attempt, test.retryAfter, delay, test.min, test.max)
+				break
+			}
+		}
+	}
+
+	if delay := policy.delay(0, nil); delay < RETRY_BASE_DELAY/2 || delay > RETRY_BASE_DELAY {
+		t.Errorf("delay without a response = %v", delay)
+	}
+}
+
+func TestParseStatuses(t *testing.T) {
+	statuses, err := parseStatuses("429, 503")
+	if err != nil || !reflect.DeepEqual(statuses, []int{429, 503}) {
+		t.Errorf("parseStatuses = %v, %v", statuses, err)
+	}
+
+	for _, text := range []string{"", "abc", "99", "600", "429,,503"} {
+		if _, err := parseStatuses(text); err == nil {
+			t.Errorf("parseStatuses(%q) has no error", text)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	if limiter := newRateLimiter(0); limiter != nil {
+		t.Errorf("newRateLimiter(0) = %v, want no limit", limiter)
+	}
+	var unlimited *rateLimiter
+	unlimited.Wait()
+
+	limiter := newRateLimiter(100)
+	begin := time.Now()
+	for i := 0; i < 5; i++ {
+		limiter.Wait()
+	}
+	if elapsed := time.Since(begin); elapsed < 40*time.Millisecond {
+		t.Errorf("5 requests at 100 rps took %v", elapsed)
+	}
+}
+
+// statusServer answers with the statuses in turn, then with 200.
+func statusServer(statuses ...int) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := int(atomic.AddInt32(&requests, 1)) - 1
+		if i < len(statuses) {
+			w.WriteHeader(statuses[i])
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	return server, &requests
+}
+
+func TestLineSourceRetry(t *testing.T) {
+	server, requests := statusServer(http.StatusServiceUnavailable)
+	defer server.Close()
+
+	source := NewLineSource(server.URL)
+	source.Retry = newRetryPolicy(1, defaultRetryStatuses)
+	body, err := source.FetchMeta(1)
+	if err != nil {
+		t.Fatalf("FetchMeta err: %v", err)
+	}
+	data, _ := ioutil.ReadAll(body)
+	body.Close()
+	if string(data) != "ok" || *requests != 2 {
+		t.Errorf("FetchMeta = %q after %d requests, want ok after 2", data, *requests)
+	}
+}
+
+func TestLineSourceRetryGivesUp(t *testing.T) {
+	server, requests := statusServer(http.StatusServiceUnavailable)
+	defer server.Close()
+
+	source := NewLineSource(server.URL)
+	source.Retry = newRetryPolicy(0, defaultRetryStatuses)
+	_, err := source.FetchMeta(1)
+	if err == nil || err == ErrNotFound || *requests != 1 {
+		t.Errorf("FetchMeta err: %v after %d requests, want a failure after 1", err, *requests)
+	}
+}
+
+func TestLineSourceDoesNotRetryOtherStatuses(t *testing.T) {
+	server, requests := statusServer(http.StatusForbidden)
+	defer server.Close()
+
+	source := NewLineSource(server.URL)
+	_, err := source.FetchMeta(1)
+	if err != ErrNotFound || *requests != 1 {
+		t.Errorf("FetchMeta err: %v after %d requests, want ErrNotFound after 1", err, *requests)
+	}
+}
@@ -1,21 +1,33 @@
 package main
 
 import (
-	"bytes"
+	"container/list"
+	"crypto/sha1"
+	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
 	IMAGE_MIME_TYPE                = "image/jpeg"
 	IMAGE_EXTENSION                = ".jpg"
+	PNG_MIME_TYPE                  = "image/png"
+	PNG_EXTENSION                  = ".png"
+	WEBP_MIME_TYPE                 = "image/webp"
+	WEBP_EXTENSION                 = ".webp"
+	SOUND_MIME_TYPE                = "audio/mp4"
+	SOUND_EXTENSION                = ".m4a"
+	STICKER_CACHE_CONTROL          = "public, max-age=604800"
 	LINE_STORE_URL                 = "https://store.line.me"
 	OFFICIAL_STICKER_SEARCH_FORMAT = LINE_STORE_URL + "/stickershop/search/en?page=%d&q=%s"
 	CREATOR_STICKER_SEARCH_FORMAT  = LINE_STORE_URL + "/stickershop/search/creators/en?page=%d&q=%s"
@@ -29,6 +41,10 @@ func Run(port int) {
 	http.HandleFunc("/sticker", stickerHandler)
 	http.HandleFunc("/pkg-list", pkgHandler)
 	http.HandleFunc("/pkg-count", pkgCountHandler)
+	http.HandleFunc("/suggest", suggestHandler)
+	http.HandleFunc("/sticker-info", stickerLookupHandler)
+	http.HandleFunc("/lookup", stickerLookupHandler)
+	setupAPIV2()
 	logger.Fatal(http.ListenAndServe(":"+fmt.Sprint(port), nil))
 }
 
@@ -36,11 +52,26 @@ func testHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	fmt.Fprintln(w, "test at", time.Now(), "\n")
 	fmt.Fprintln(w, "APIs:")
-	fmt.Fprintln(w, "meta?repo=<REPO>&pkg=<INT>")
-	fmt.Fprintln(w, "sticker?pkg=<INT>&sticker=<INT>[&base64=<0|1>]")
-	fmt.Fprintln(w, "pkg-list?repo=<REPO>&page=<INT>&size=<INT>&order=<packageId|date>[&q=<STRING>]")
-	fmt.Fprintln(w, "pkg-count?repo=<REPO>[&q=<STRING>]")
+	fmt.Fprintln(w, "meta?repo=<REPO>&pkg=<INT>[&lang=<LANG>]")
+	fmt.Fprintln(w, "sticker?pkg=<INT>&sticker=<INT>[&kind=<static|animation|sound>][&format=<jpg|png|webp>][&size=<thumb|full>][&w=<SIZE>][&h=<SIZE>][&base64=<0|1>]")
+	fmt.Fprintln(w, "<SIZE>=<"+variantSizesText()+">")
+	fmt.Fprintln(w, "pkg-list?repo=<REPO>&page=<INT>&size=<INT>&order=<packageId|date|relevance>[&q=<STRING>][&qlang=<LANG>][&fuzzy=<0|1>][&min_stickers=<INT>][&max_stickers=<INT>][&lang=<LANG>][&cursor=<X-Next-Cursor>]")
+	fmt.Fprintln(w, "pkg-count?repo=<REPO>[&q=<STRING>][&qlang=<LANG>][&fuzzy=<0|1>][&min_stickers=<INT>][&max_stickers=<INT>]")
+	fmt.Fprintln(w, "suggest?repo=<REPO>&prefix=<STRING>[&limit=<INT>]")
+	fmt.Fprintln(w, "lookup?sticker=<INT>[&lang=<LANG>] (also sticker-info)")
 	fmt.Fprintln(w, "<REPO>=<official|creator|custom>")
+	fmt.Fprintln(w, "pkg-list, pkg-count and suggest also take repo=all or a comma separated list of <REPO>")
+	fmt.Fprintln(w, "lang adds the title and author in <LANG> with fallback, qlang searches only <LANG>")
+	fmt.Fprintln(w, `q takes "exact phrase", title:<WORD>, author:<WORD>, -<excluded> and OR`)
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "v2 APIs (JSON envelope with data, error and pagination):")
+	fmt.Fprintln(w, "v2/packages?repo=<REPO>&<page=<INT>|cursor=<next_cursor>>&size=<INT>&order=<packageId|date|relevance>[&q=<STRING>][&qlang=<LANG>][&fuzzy=<0|1>][&min_stickers=<INT>][&max_stickers=<INT>][&lang=<LANG>]")
+	fmt.Fprintln(w, "v2/packages/count?repo=<REPO>[&q=<STRING>][&qlang=<LANG>][&fuzzy=<0|1>][&min_stickers=<INT>][&max_stickers=<INT>]")
+	fmt.Fprintln(w, "v2/packages/<INT>[?lang=<LANG>]")
+	fmt.Fprintln(w, "DELETE v2/packages/<INT> with Authorization: Bearer <$PONYSTICKER_ADMIN_TOKEN>")
+	fmt.Fprintln(w, "v2/sticker?<same as sticker>")
+	fmt.Fprintln(w, "v2/suggest?<same as suggest>")
+	fmt.Fprintln(w, "v2/lookup?<same as lookup> (also v2/sticker-info)")
 }
 
 func metaHandler(w http.ResponseWriter, r *http.Request) {
@@ -52,19 +83,15 @@ func metaHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	repo := r.FormValue("repo")
-	if repo != "official" && repo != "creator" && repo != "custom" {
-		http.Error(w, "parameter repo format error", http.StatusBadRequest)
+	repo, err := parseRepo(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	stickerDBLock.Lock()
-	defer stickerDBLock.Unlock()
-
-	var meta string
-	err = stickerDB.QueryRow("SELECT meta FROM "+repo+" WHERE packageId=?", packageId).Scan(&meta)
+	meta, err := findMeta(repo, packageId)
 	if err != nil {
-		if err.Error() == "sql: no rows in result set" {
+		if err == sql.ErrNoRows {
 			http.Error(w, "no such package", http.StatusNotFound)
 		} else {
 			logger.Println(err)
@@ -72,208 +99,263 @@ func metaHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	fmt.Fprint(w, meta)
+	if lang := r.FormValue("lang"); lang != "" {
+		meta, err = localizeMeta(meta, lang)
+		if err != nil {
+			logger.Println(err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, meta)
+}
+
+func findMeta(repo string, packageId int) (string, error) {
+	stickerDBLock.Lock()
+	defer stickerDBLock.Unlock()
+
+	var meta string
+	err := stickerDB.QueryRow("SELECT meta FROM "+repo+" WHERE packageId=?", packageId).Scan(&meta)
+	return meta, err
 }
 
 func stickerHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
+	serveSticker(w, r, http.Error)
+}
+
+// errorWriter reports a failed request. Legacy handlers use http.Error,
+// the v2 API writes a JSON envelope instead.
+type errorWriter func(w http.ResponseWriter, message string, status int)
 
+func serveSticker(w http.ResponseWriter, r *http.Request, fail errorWriter) {
 	packageId := r.FormValue("pkg")
 	if _, err := strconv.Atoi(packageId); err != nil {
-		http.Error(w, "parameter pkg must be an integer", http.StatusBadRequest)
+		fail(w, "parameter pkg must be an integer", http.StatusBadRequest)
 		return
 	}
 
 	sticker := r.FormValue("sticker")
 	if sticker != "tab_on" && sticker != "tab_off" {
 		if _, err := strconv.Atoi(strings.Replace(sticker, "_key", "", -1)); err != nil {
-			http.Error(w, "parameter sticker format error", http.StatusBadRequest)
+			fail(w, "parameter sticker format error", http.StatusBadRequest)
 			return
 		}
 	}
 
-	isBase64 := r.FormValue("base64")
-
-	filePath := path.Join(stickerDirectory, packageId, sticker+IMAGE_EXTENSION)
-	file, err := os.Open(filePath)
-	if err != nil {
-		if strings.Contains(err.Error(), "no such file or directory") {
-			http.Error(w, "no such file", http.StatusNotFound)
-		} else {
-			logger.Println(err.Error())
-			http.Error(w, "internal server error", http.StatusInternalServerError)
-		}
+	var mimeType, extension string
+	switch r.FormValue("format") {
+	case "", "jpg":
+		mimeType, extension = IMAGE_MIME_TYPE, IMAGE_EXTENSION
+	case "png":
+		mimeType, extension = PNG_MIME_TYPE, PNG_EXTENSION
+	case "webp":
+		mimeType, extension = WEBP_MIME_TYPE, WEBP_EXTENSION
+	default:
+		fail(w, "parameter format error", http.StatusBadRequest)
 		return
 	}
 
-	if isBase64 == "1" {
-		buf := bytes.NewBuffer(nil)
-		_, err = io.Copy(buf, file)
-		if err != nil {
-			logger.Panicln(err.Error())
-			http.Error(w, "internal server error", http.StatusInternalServerError)
+	var width, height uint
+	if size := r.FormValue("size"); size != "" {
+		preset, ok := sizePresets[size]
+		if !ok {
+			fail(w, "parameter size format error", http.StatusBadRequest)
 			return
 		}
-		str := base64.StdEncoding.EncodeToString(buf.Bytes())
-		_, err := fmt.Fprint(w, str)
-		if err != nil {
-			logger.Panicln(err.Error())
-			http.Error(w, "internal server error", http.StatusInternalServerError)
+		width, height = preset[0], preset[1]
+	}
+	if r.FormValue("w") != "" {
+		value, err := strconv.ParseUint(r.FormValue("w"), 10, 0)
+		if err != nil || !isVariantSize(uint(value)) {
+			fail(w, "parameter w must be one of "+variantSizesText(), http.StatusBadRequest)
 			return
 		}
-	} else {
-		_, err = io.Copy(w, file)
-		if err != nil {
-			logger.Panicln(err.Error())
-			http.Error(w, "internal server error", http.StatusInternalServerError)
+		width = uint(value)
+	}
+	if r.FormValue("h") != "" {
+		value, err := strconv.ParseUint(r.FormValue("h"), 10, 0)
+		if err != nil || !isVariantSize(uint(value)) {
+			fail(w, "parameter h must be one of "+variantSizesText(), http.StatusBadRequest)
 			return
 		}
+		height = uint(value)
 	}
-	w.Header().Set("Content-Type", IMAGE_MIME_TYPE)
-}
 
-func pkgCountHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	repo := r.FormValue("repo")
-	if repo != "official" && repo != "creator" && repo != "custom" {
-		http.Error(w, "parameter repo format error", http.StatusBadRequest)
-		return
-	}
-	query := r.FormValue("q")
+	isBase64 := r.FormValue("base64")
 
+	var file *os.File
+	var filePath string
 	var err error
-	var count int
-	if query == "" {
-		err = stickerDB.QueryRow("SELECT count FROM meta WHERE name=?", repo).Scan(&count)
-	} else {
-		repo_fts := repo + "_fts"
-		err = stickerDB.QueryRow("SELECT COUNT(meta) "+
-			"FROM "+repo+","+repo_fts+
-			" WHERE "+repo_fts+" MATCH ? "+
-			"AND "+repo+".packageId="+repo_fts+".packageId",
-			transformQueryText(query)).Scan(&count)
-	}
-
-	if err != nil {
-		logger.Println(err.Error())
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+	packageDirectory := path.Join(stickerDirectory, packageId)
+	switch r.FormValue("kind") {
+	case "", "static":
+		filePath, err = stickerVariant(packageDirectory, sticker, extension, width, height)
+	case "animation":
+		// animations are apng, served as they are
+		mimeType = PNG_MIME_TYPE
+		filePath = path.Join(packageDirectory, ANIMATION_DIRECTORY, sticker+PNG_EXTENSION)
+	case "sound":
+		mimeType = SOUND_MIME_TYPE
+		filePath = path.Join(packageDirectory, SOUND_DIRECTORY, sticker+SOUND_EXTENSION)
+	default:
+		fail(w, "parameter kind format error", http.StatusBadRequest)
 		return
 	}
-
-	_, err = fmt.Fprint(w, count)
+	if err == nil {
+		file, err = os.Open(filePath)
+	}
 	if err != nil {
-		logger.Println(err.Error())
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+		if strings.Contains(err.Error(), "no such file or directory") {
+			fail(w, "no such file", http.StatusNotFound)
+		} else {
+			logger.Println(err.Error())
+			fail(w, "internal server error", http.StatusInternalServerError)
+		}
 		return
 	}
-}
 
-func pkgHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	defer file.Close()
 
-	page, err := strconv.Atoi(r.FormValue("page"))
+	info, err := file.Stat()
 	if err != nil {
-		http.Error(w, "parameter page must be an integer", http.StatusBadRequest)
+		logger.Println(err.Error())
+		fail(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	size, err := strconv.Atoi(r.FormValue("size"))
+	etag, err := fileETag(filePath, info, file)
 	if err != nil {
-		http.Error(w, "parameter size must be an integer", http.StatusBadRequest)
+		logger.Println(err.Error())
+		fail(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	repo := r.FormValue("repo")
-	if repo != "official" && repo != "creator" && repo != "custom" {
-		http.Error(w, "parameter repo format error", http.StatusBadRequest)
-		return
+	// ServeContent answers If-None-Match, If-Modified-Since and Range
+	// from these headers, so they must be set before it writes anything.
+	var content io.ReadSeeker = file
+	if isBase64 == "1" {
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			logger.Println(err.Error())
+			fail(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		content = strings.NewReader(base64.StdEncoding.EncodeToString(data))
+		mimeType = "text/plain; charset=utf-8"
+		etag = strings.TrimSuffix(etag, `"`) + `-base64"`
 	}
 
-	order := r.FormValue("order")
-	if order != "packageId" && order != "date" {
-		http.Error(w, "parameter order format error", http.StatusBadRequest)
-		return
-	}
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", STICKER_CACHE_CONTROL)
+	http.ServeContent(w, r, "", info.ModTime(), content)
+}
+
+// ETAG_CACHE_SIZE is how many files fileETag remembers the hash of.
+const ETAG_CACHE_SIZE = 4096
+
+type etagEntry struct {
+	filePath string
+	modTime  time.Time
+	size     int64
+	etag     string
+}
+
+// etagCache keeps the most recently served files in front of etagList.
+var (
+	etagCache     = make(map[string]*list.Element)
+	etagList      = list.New()
+	etagCacheLock sync.Mutex
+)
 
-	query := r.FormValue("q")
-	if query == "" {
-		err = listPackage(w, repo, page, size, order)
-	} else {
-		err = queryPackage(w, repo, page, size, order, query)
+// fileETag returns a strong ETag from the sha1 of the file content. The
+// hash is remembered until the file changes or it is the least recently
+// used of ETAG_CACHE_SIZE files.
+func fileETag(filePath string, info os.FileInfo, file io.ReadSeeker) (string, error) {
+	etagCacheLock.Lock()
+	if element, ok := etagCache[filePath]; ok {
+		entry := element.Value.(*etagEntry)
+		if entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+			etagList.MoveToFront(element)
+			etagCacheLock.Unlock()
+			return entry.etag, nil
+		}
 	}
+	etagCacheLock.Unlock()
 
+	hash := sha1.New()
+	_, err := io.Copy(hash, file)
 	if err != nil {
-		logger.Println(err.Error())
-		http.Error(w, "internal server error", http.StatusInternalServerError)
-		return
+		return "", err
 	}
-}
-
-func queryPackage(w http.ResponseWriter, repo string, page, size int, order, query string) error {
-	tx, err := stickerDB.Begin()
+	_, err = file.Seek(0, io.SeekStart)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	repo_fts := repo + "_fts"
-	pkgRows, err := tx.Query("SELECT meta FROM "+repo+","+repo_fts+
-		" WHERE "+repo_fts+" MATCH ? AND "+repo+".packageId="+repo_fts+".packageId "+
-		"ORDER BY "+repo+"."+order+" "+
-		"LIMIT ? OFFSET ?",
-		transformQueryText(query), size, (page-1)*size)
+	etag := `"` + hex.EncodeToString(hash.Sum(nil)) + `"`
+	entry := &etagEntry{filePath, info.ModTime(), info.Size(), etag}
+	etagCacheLock.Lock()
+	defer etagCacheLock.Unlock()
+	if element, ok := etagCache[filePath]; ok {
+		element.Value = entry
+		etagList.MoveToFront(element)
+		return etag, nil
+	}
+	etagCache[filePath] = etagList.PushFront(entry)
+	if etagList.Len() > ETAG_CACHE_SIZE {
+		oldest := etagList.Back()
+		etagList.Remove(oldest)
+		delete(etagCache, oldest.Value.(*etagEntry).filePath)
+	}
+	return etag, nil
+}
 
+func pkgCountHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	params, err := parseCountParams(r)
 	if err != nil {
-		return err
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	metalist := make([]string, 0, size)
-	for pkgRows.Next() {
-		var meta string
-		err = pkgRows.Scan(&meta)
-		if err != nil {
-			return err
-		}
-		metalist = append(metalist, meta)
-	}
-	err = tx.Commit()
+	count, err := countPackage(params)
 	if err != nil {
-		return err
+		logger.Println(err.Error())
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
 	}
-	res := "[" + strings.Join(metalist, ",") + "]"
-	fmt.Fprint(w, res)
-	w.Header().Set("Content-Type", "application/json")
-	return nil
-}
 
-func listPackage(w http.ResponseWriter, repo string, page, size int, order string) error {
-	tx, err := stickerDB.Begin()
+	_, err = fmt.Fprint(w, count)
 	if err != nil {
-		return err
+		logger.Println(err.Error())
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
 	}
+}
 
-	pkgRows, err := tx.Query(`SELECT meta FROM `+repo+
-		` ORDER BY `+order+` LIMIT ?  OFFSET ?`,
-		size, (page-1)*size)
+func pkgHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	params, err := parsePkgParams(r)
 	if err != nil {
-		return err
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	metalist := make([]string, 0, size)
-	for pkgRows.Next() {
-		var meta string
-		err = pkgRows.Scan(&meta)
-		if err != nil {
-			return err
-		}
-		metalist = append(metalist, meta)
-	}
-	err = tx.Commit()
+	metalist, nextCursor, _, err := findPackages(params)
 	if err != nil {
-		return err
+		logger.Println(err.Error())
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
 	}
+
 	res := "[" + strings.Join(metalist, ",") + "]"
-	fmt.Fprint(w, res)
+	if nextCursor != "" {
+		w.Header().Set("X-Next-Cursor", nextCursor)
+	}
 	w.Header().Set("Content-Type", "application/json")
-	return nil
+	fmt.Fprint(w, res)
 }
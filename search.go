@@ -0,0 +1,349 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var allRepos = []string{"official", "creator", "custom"}
+
+type pkgParams struct {
+	repos     []string
+	page      int
+	size      int
+	order     string
+	query     string
+	queryLang string
+	fuzzy     bool
+	// match is the FTS expression of query
+	match string
+	// minStickers and maxStickers are 0 when not set
+	minStickers int
+	maxStickers int
+	lang        string
+	cursor      *pkgCursor
+}
+
+func parseRepo(r *http.Request) (string, error) {
+	repo := r.FormValue("repo")
+	if repo != "official" && repo != "creator" && repo != "custom" {
+		return "", errors.New("parameter repo format error")
+	}
+	return repo, nil
+}
+
+// parseRepos accepts a single repo, a comma separated list or "all".
+func parseRepos(r *http.Request) ([]string, error) {
+	value := r.FormValue("repo")
+	if value == "all" {
+		return allRepos, nil
+	}
+
+	selected := make(map[string]bool)
+	for _, repo := range strings.Split(value, ",") {
+		if repo != "official" && repo != "creator" && repo != "custom" {
+			return nil, errors.New("parameter repo format error")
+		}
+		selected[repo] = true
+	}
+
+	// keep the order of allRepos so the same selection builds the same query
+	repos := make([]string, 0, len(selected))
+	for _, repo := range allRepos {
+		if selected[repo] {
+			repos = append(repos, repo)
+		}
+	}
+	return repos, nil
+}
+
+func parsePkgParams(r *http.Request) (pkgParams, error) {
+	var params pkgParams
+	var err error
+
+	// page is not needed when paging with a cursor
+	cursor := r.FormValue("cursor")
+	if cursor == "" || r.FormValue("page") != "" {
+		params.page, err = strconv.Atoi(r.FormValue("page"))
+		if err != nil {
+			return params, errors.New("parameter page must be an integer")
+		}
+	}
+
+	params.size, err = strconv.Atoi(r.FormValue("size"))
+	if err != nil {
+		return params, errors.New("parameter size must be an integer")
+	}
+
+	params.repos, err = parseRepos(r)
+	if err != nil {
+		return params, err
+	}
+
+	err = parseSearch(r, &params)
+	if err != nil {
+		return params, err
+	}
+	params.lang = r.FormValue("lang")
+
+	params.order = r.FormValue("order")
+	switch params.order {
+	case "relevance":
+		if params.query == "" {
+			return params, errors.New("parameter order relevance needs parameter q")
+		}
+	case "packageId", "date":
+	default:
+		return params, errors.New("parameter order format error")
+	}
+
+	if cursor != "" && (params.order == "relevance" || params.fuzzy) {
+		return params, errors.New("parameter cursor does not work with order relevance or fuzzy")
+	}
+
+	if cursor != "" {
+		params.cursor, err = parsePkgCursor(cursor, params.order)
+		if err != nil {
+			return params, err
+		}
+	}
+	return params, nil
+}
+
+// findPackages returns the metas of the page and the cursor of the next
+// page, which is empty after the last page. Metas from more than one repo
+// are tagged with the repo they come from. Ranking scores the matches, so
+// it also returns their total, otherwise the total is -1. A fuzzy total
+// counts only the candidates scorePackages looks at, like countPackage.
+func findPackages(params pkgParams) ([]string, string, int, error) {
+	if params.order == "relevance" || (params.fuzzy && params.query != "") {
+		metalist, total, err := rankPackages(params)
+		return metalist, "", total, err
+	}
+
+	tx, err := stickerDB.Begin()
+	if err != nil {
+		return nil, "", 0, err
+	}
+	defer tx.Rollback()
+
+	query, args := pagedSelect(params)
+	pkgRows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	metalist, nextCursor, err := scanPackages(pkgRows, params)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	return metalist, nextCursor, -1, tx.Commit()
+}
+
+// pagedSelect builds the page query from either the cursor or the page
+// number of params. Package ids never overlap between repos, so the
+// selected repos are merged with UNION ALL under one ordering.
+func pagedSelect(params pkgParams) (string, []interface{}) {
+	selects := make([]string, 0, len(params.repos))
+	args := make([]interface{}, 0)
+	for _, repo := range params.repos {
+		from, conditions, filterArgs := filterConditions(repo, params)
+		args = append(args, filterArgs...)
+		if params.cursor != nil {
+			condition, cursorArgs := params.cursor.condition(repo)
+			conditions = append(conditions, condition)
+			args = append(args, cursorArgs...)
+		}
+
+		where := ""
+		if len(conditions) > 0 {
+			where = " WHERE " + strings.Join(conditions, " AND ")
+		}
+		selects = append(selects, "SELECT '"+repo+"' AS repo, "+
+			repo+".packageId AS packageId, "+
+			repo+".date AS date, "+
+			repo+".meta AS meta FROM "+from+where)
+	}
+
+	offset := (params.page - 1) * params.size
+	if params.cursor != nil {
+		offset = 0
+	}
+	args = append(args, params.size, offset)
+	return strings.Join(selects, " UNION ALL ") +
+		" ORDER BY " + orderBy(params.order) +
+		" LIMIT ? OFFSET ?", args
+}
+
+func scanPackages(pkgRows *sql.Rows, params pkgParams) ([]string, string, error) {
+	defer pkgRows.Close()
+
+	metalist := make([]string, 0, params.size)
+	var last pkgCursor
+	for pkgRows.Next() {
+		var repo, meta string
+		err := pkgRows.Scan(&repo, &last.packageId, &last.date, &meta)
+		if err != nil {
+			return nil, "", err
+		}
+		meta, err = decorateMeta(meta, repo, params)
+		if err != nil {
+			return nil, "", err
+		}
+		metalist = append(metalist, meta)
+	}
+	err := pkgRows.Err()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(metalist) == 0 || len(metalist) < params.size {
+		return metalist, "", nil
+	}
+	last.order = params.order
+	return metalist, last.String(), nil
+}
+
+// decorateMeta tags metas merged from several repos with their repo and
+// adds the title and author of the requested language.
+func decorateMeta(meta, repo string, params pkgParams) (string, error) {
+	var err error
+	if params.lang != "" {
+		meta, err = localizeMeta(meta, params.lang)
+		if err != nil {
+			return "", err
+		}
+	}
+	if len(params.repos) > 1 {
+		meta, err = prependMember(meta, "repo", repo)
+	}
+	return meta, err
+}
+
+// filterConditions returns the tables to select packages of repo from and
+// the conditions of the search and filter parameters. Hidden packages are
+// always left out.
+func filterConditions(repo string, params pkgParams) (string, []string, []interface{}) {
+	from := repo
+	conditions := []string{repo + ".hidden=0"}
+	args := make([]interface{}, 0)
+	if params.query != "" {
+		repo_fts, condition, matchArgs := matchCondition(repo, params)
+		from += "," + repo_fts
+		conditions = append(conditions, condition)
+		args = append(args, matchArgs...)
+	}
+	if params.minStickers > 0 {
+		conditions = append(conditions, repo+".stickerCount>=?")
+		args = append(args, params.minStickers)
+	}
+	if params.maxStickers > 0 {
+		conditions = append(conditions, repo+".stickerCount<=?")
+		args = append(args, params.maxStickers)
+	}
+	return from, conditions, args
+}
+
+// matchCondition returns the FTS table to join with repo and the condition
+// matching the query, scoped to the rows of queryLang when it is set.
+func matchCondition(repo string, params pkgParams) (string, string, []interface{}) {
+	if params.queryLang == "" {
+		repo_fts := repo + "_fts"
+		return repo_fts,
+			repo_fts + " MATCH ? AND " + repo + ".packageId=" + repo_fts + ".packageId",
+			[]interface{}{params.match}
+	}
+
+	repo_fts := repo + "_locale_fts"
+	return repo_fts,
+		repo_fts + " MATCH ? AND " + repo + ".packageId=" + repo_fts + ".packageId AND " + repo_fts + ".lang=?",
+		[]interface{}{params.match, params.queryLang}
+}
+
+// parseCountParams reads the parameters of pkg-count, which are the search
+// parameters of pkg-list without paging and order.
+func parseCountParams(r *http.Request) (pkgParams, error) {
+	var params pkgParams
+	var err error
+	params.repos, err = parseRepos(r)
+	if err != nil {
+		return params, err
+	}
+	err = parseSearch(r, &params)
+	return params, err
+}
+
+// parseSearch reads the search and filter parameters shared by pkg-list
+// and pkg-count.
+func parseSearch(r *http.Request, params *pkgParams) error {
+	var err error
+	params.minStickers, err = parseStickerCount(r, "min_stickers")
+	if err != nil {
+		return err
+	}
+	params.maxStickers, err = parseStickerCount(r, "max_stickers")
+	if err != nil {
+		return err
+	}
+
+	params.query = r.FormValue("q")
+	params.queryLang = r.FormValue("qlang")
+	params.fuzzy = r.FormValue("fuzzy") == "1"
+	if params.query == "" {
+		return nil
+	}
+
+	if params.fuzzy {
+		params.match = fuzzyQueryText(queryText(params.query), params.queryLang)
+		if params.match == "" {
+			return errors.New("parameter q has no term to search")
+		}
+		return nil
+	}
+
+	params.match, err = matchExpression(params.query, params.queryLang)
+	return err
+}
+
+func parseStickerCount(r *http.Request, name string) (int, error) {
+	if r.FormValue(name) == "" {
+		return 0, nil
+	}
+
+	count, err := strconv.Atoi(r.FormValue(name))
+	if err != nil || count < 1 {
+		return 0, errors.New("parameter " + name + " must be a positive integer")
+	}
+	return count, nil
+}
+
+func countPackage(params pkgParams) (int, error) {
+	if params.fuzzy && params.query != "" {
+		ranked, err := scorePackages(params)
+		return len(ranked), err
+	}
+
+	var total int
+	for _, repo := range params.repos {
+		var err error
+		var count int
+		from, conditions, args := filterConditions(repo, params)
+		if params.query == "" && params.minStickers == 0 && params.maxStickers == 0 {
+			// meta keeps the count of the visible packages
+			err = stickerDB.QueryRow("SELECT count FROM meta WHERE name=?", repo).Scan(&count)
+		} else {
+			err = stickerDB.QueryRow("SELECT COUNT(meta) "+
+				"FROM "+from+
+				" WHERE "+strings.Join(conditions, " AND "),
+				args...).Scan(&count)
+		}
+		if err != nil {
+			return 0, err
+		}
+		total += count
+	}
+	return total, nil
+}
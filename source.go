@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	LINE_URL   string = "http://dl.stickershop.line.naver.jp/products/0/0/1"
+	ZIP_FORMAT string = "/%d/android/stickers.zip"
+	//ZIP_FORMAT       string = "http://line.polppolservice.com/getpng/stickers/sticker%s.zip"
+	META_FORMAT      string = "/%d/android/productInfo.meta"
+	TAB_ON_FORMAT    string = "/%d/android/tab_on.png"
+	TAB_OFF_FORMAT   string = "/%d/android/tab_off.png"
+	STICKER_FORMAT   string = "/%d/android/stickers/%s.png"
+	THUMBNAIL_FORMAT string = "/%d/android/stickers/%s_key.png"
+	ANIMATION_FORMAT string = "/%d/android/animation/%s.png"
+	SOUND_FORMAT     string = "/%d/android/sound/%s.m4a"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// StickerSource is where the update crawler fetches packages from.
+// Every method returns ErrNotFound when the upstream does not have the
+// requested file.
+type StickerSource interface {
+	// FetchArchive returns the stickers.zip of the package.
+	FetchArchive(id int) (io.ReadCloser, error)
+	// FetchMeta returns the original productInfo.meta of the package.
+	FetchMeta(id int) (io.ReadCloser, error)
+	// FetchSticker returns a single file named the way it is stored on
+	// disk without extension: "<sticker>", "<sticker>_key", "tab_on",
+	// "tab_off", "animation/<sticker>" or "sound/<sticker>".
+	FetchSticker(id int, name string) (io.ReadCloser, error)
+}
+
+var stickerSource StickerSource
+
+// setupStickerSource picks the source from $PONYSTICKER_SOURCE: an http(s)
+// url is used as a LINE compatible CDN, anything else as a local mirror
+// directory. The LINE CDN is used when it is not set.
+func setupStickerSource() {
+	location := os.Getenv("PONYSTICKER_SOURCE")
+	switch {
+	case location == "":
+		stickerSource = NewLineSource(LINE_URL)
+	case strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://"):
+		stickerSource = NewLineSource(strings.TrimSuffix(location, "/"))
+	default:
+		stickerSource = NewDirectorySource(location)
+	}
+}
+
+func stickerPath(id int, name string) string {
+	switch {
+	case name == "tab_on":
+		return fmt.Sprintf(TAB_ON_FORMAT, id)
+	case name == "tab_off":
+		return fmt.Sprintf(TAB_OFF_FORMAT, id)
+	case path.Dir(name) == ANIMATION_DIRECTORY:
+		return fmt.Sprintf(ANIMATION_FORMAT, id, path.Base(name))
+	case path.Dir(name) == SOUND_DIRECTORY:
+		return fmt.Sprintf(SOUND_FORMAT, id, path.Base(name))
+	case strings.HasSuffix(name, "_key"):
+		return fmt.Sprintf(THUMBNAIL_FORMAT, id, strings.TrimSuffix(name, "_key"))
+	}
+	return fmt.Sprintf(STICKER_FORMAT, id, name)
+}
+
+type LineSource struct {
+	BaseURL string
+	Client  *http.Client
+	Limiter *rateLimiter
+	Retry   retryPolicy
+}
+
+func NewLineSource(baseURL string) *LineSource {
+	return &LineSource{
+		BaseURL: baseURL,
+		Client:  http.DefaultClient,
+		Retry:   newRetryPolicy(DEFAULT_RETRIES, defaultRetryStatuses),
+	}
+}
+
+func (self *LineSource) FetchArchive(id int) (io.ReadCloser, error) {
+	return self.get(fmt.Sprintf(ZIP_FORMAT, id))
+}
+
+func (self *LineSource) FetchMeta(id int) (io.ReadCloser, error) {
+	return self.get(fmt.Sprintf(META_FORMAT, id))
+}
+
+func (self *LineSource) FetchSticker(id int, name string) (io.ReadCloser, error) {
+	return self.get(stickerPath(id, name))
+}
+
+// get retries transport errors and the statuses of the retry policy with
+// backoff. Any other error status means the file does not exist.
+func (self *LineSource) get(urlPath string) (io.ReadCloser, error) {
+	url := self.BaseURL + urlPath
+	for attempt := 0; ; attempt++ {
+		self.Limiter.Wait()
+		res, err := self.Client.Get(url)
+		switch {
+		case err != nil:
+		case res.StatusCode < 400:
+			return res.Body, nil
+		case self.Retry.retryStatus(res.StatusCode):
+			res.Body.Close()
+			err = fmt.Errorf("%s: %s", url, res.Status)
+		default:
+			res.Body.Close()
+			return nil, ErrNotFound
+		}
+
+		if attempt >= self.Retry.retries {
+			logger.Println("http.Get err:", err)
+			return nil, err
+		}
+		time.Sleep(self.Retry.delay(attempt, res))
+	}
+}
+
+// DirectorySource reads packages from a local mirror laid out the same way
+// as the LINE CDN, e.g. <Root>/<id>/android/stickers.zip.
+type DirectorySource struct {
+	Root string
+}
+
+func NewDirectorySource(root string) *DirectorySource {
+	return &DirectorySource{Root: root}
+}
+
+func (self *DirectorySource) FetchArchive(id int) (io.ReadCloser, error) {
+	return self.open(fmt.Sprintf(ZIP_FORMAT, id))
+}
+
+func (self *DirectorySource) FetchMeta(id int) (io.ReadCloser, error) {
+	return self.open(fmt.Sprintf(META_FORMAT, id))
+}
+
+func (self *DirectorySource) FetchSticker(id int, name string) (io.ReadCloser, error) {
+	return self.open(stickerPath(id, name))
+}
+
+func (self *DirectorySource) open(filePath string) (io.ReadCloser, error) {
+	file, err := os.Open(filepath.Join(self.Root, filepath.FromSlash(filePath)))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return file, err
+}
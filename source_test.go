@@ -0,0 +1,187 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+// fileServer is a stand-in for the LINE CDN serving files by url path.
+func fileServer(files map[string][]byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+}
+
+func testPNG(t *testing.T) []byte {
+	var buffer bytes.Buffer
+	err := png.Encode(&buffer, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func testOriginalMeta(id int) []byte {
+	return []byte(fmt.Sprintf(`{"packageId":%d,"title":{"en":"Pony"},"author":{"en":"Pony"},"stickers":[{"id":10}]}`, id))
+}
+
+func testArchive(t *testing.T, files map[string][]byte) []byte {
+	var buffer bytes.Buffer
+	writer := zip.NewWriter(&buffer)
+	for name, data := range files {
+		file, err := writer.Create(name)
+		if err == nil {
+			_, err = file.Write(data)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestStickerPath(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"10", "/1/android/stickers/10.png"},
+		{"10_key", "/1/android/stickers/10_key.png"},
+		{"tab_on", "/1/android/tab_on.png"},
+		{"tab_off", "/1/android/tab_off.png"},
+		{"animation/10", "/1/android/animation/10.png"},
+		{"sound/10", "/1/android/sound/10.m4a"},
+	}
+
+	for _, test := range tests {
+		if got := stickerPath(1, test.name); got != test.want {
+			t.Errorf("stickerPath(1, %q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLineSource(t *testing.T) {
+	server := fileServer(map[string][]byte{
+		"/1/android/productInfo.meta":    []byte("meta"),
+		"/1/android/stickers.zip":        []byte("zip"),
+		"/1/android/stickers/10_key.png": []byte("key"),
+	})
+	defer server.Close()
+
+	source := NewLineSource(server.URL)
+	fetches := []struct {
+		name  string
+		fetch func() (io.ReadCloser, error)
+		want  string
+	}{
+		{"meta", func() (io.ReadCloser, error) { return source.FetchMeta(1) }, "meta"},
+		{"archive", func() (io.ReadCloser, error) { return source.FetchArchive(1) }, "zip"},
+		{"key", func() (io.ReadCloser, error) { return source.FetchSticker(1, "10_key") }, "key"},
+	}
+	for _, fetch := range fetches {
+		body, err := fetch.fetch()
+		if err != nil {
+			t.Errorf("fetch %s err: %v", fetch.name, err)
+			continue
+		}
+		data, _ := ioutil.ReadAll(body)
+		body.Close()
+		if string(data) != fetch.want {
+			t.Errorf("fetch %s = %q, want %q", fetch.name, data, fetch.want)
+		}
+	}
+
+	if _, err := source.FetchSticker(1, "tab_on"); err != ErrNotFound {
+		t.Errorf("FetchSticker of a missing file err: %v, want ErrNotFound", err)
+	}
+}
+
+func TestDirectorySource(t *testing.T) {
+	root, err := ioutil.TempDir("", "ponysticker-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	err = os.MkdirAll(filepath.Join(root, "1", "android"), os.ModePerm)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(root, "1", "android", "tab_on.png"), []byte("tab"), os.ModePerm)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := NewDirectorySource(root)
+	body, err := source.FetchSticker(1, "tab_on")
+	if err != nil {
+		t.Fatalf("FetchSticker err: %v", err)
+	}
+	data, _ := ioutil.ReadAll(body)
+	body.Close()
+	if string(data) != "tab" {
+		t.Errorf("FetchSticker = %q, want tab", data)
+	}
+
+	if _, err := source.FetchMeta(1); err != ErrNotFound {
+		t.Errorf("FetchMeta of a missing file err: %v, want ErrNotFound", err)
+	}
+}
+
+func TestDownloadFromLineSource(t *testing.T) {
+	sticker := testPNG(t)
+	archiveId, eachId := 700100, 700101
+	server := fileServer(map[string][]byte{
+		fmt.Sprintf("/%d/android/stickers.zip", archiveId): testArchive(t, map[string][]byte{
+			"productInfo.meta": testOriginalMeta(archiveId),
+			"10.png":           sticker,
+			"10_key.png":       sticker,
+		}),
+		// a package without stickers.zip is fetched file by file
+		fmt.Sprintf("/%d/android/productInfo.meta", eachId): testOriginalMeta(eachId),
+		fmt.Sprintf("/%d/android/stickers/10.png", eachId):  sticker,
+	})
+	defer server.Close()
+
+	defer func(source StickerSource) { stickerSource = source }(stickerSource)
+	stickerSource = NewLineSource(server.URL)
+
+	for _, id := range []int{archiveId, eachId} {
+		err := downlodAndInsert(id)
+		if err != nil {
+			t.Errorf("downlodAndInsert(%d) err: %v", id, err)
+			continue
+		}
+		if _, err := findMeta("official", id); err != nil {
+			t.Errorf("package %d is not inserted: %v", id, err)
+		}
+		for _, name := range []string{"10.png", "10.jpg", "productInfo.meta"} {
+			if _, err := os.Stat(path.Join(stickerDirectory, fmt.Sprint(id), name)); err != nil {
+				t.Errorf("package %d has no %s: %v", id, name, err)
+			}
+		}
+	}
+
+	if err := downlodAndInsert(700102); err != ErrNotFound {
+		t.Errorf("downlodAndInsert of a missing package err: %v, want ErrNotFound", err)
+	}
+}
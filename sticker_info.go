@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// stickerInfo tells which package a sticker belongs to.
+type stickerInfo struct {
+	StickerId int64  `json:"stickerId"`
+	PackageId int64  `json:"packageId"`
+	Repo      string `json:"repo"`
+	Position  int    `json:"position"`
+}
+
+// stickerLookup is a stickerInfo with the meta of the package.
+type stickerLookup struct {
+	stickerInfo
+	Meta json.RawMessage `json:"meta"`
+}
+
+func findStickerInfo(stickerId int64) (*stickerInfo, error) {
+	stickerDBLock.Lock()
+	defer stickerDBLock.Unlock()
+
+	info := stickerInfo{StickerId: stickerId}
+	err := stickerDB.QueryRow("SELECT packageId, position FROM stickers WHERE stickerId=? ORDER BY packageId LIMIT 1",
+		stickerId).Scan(&info.PackageId, &info.Position)
+	if err != nil {
+		return nil, err
+	}
+	info.Repo = checkRepo(int(info.PackageId))
+	return &info, nil
+}
+
+// lookupSticker finds the package of a sticker in any repo with its meta,
+// localized when lang is set.
+func lookupSticker(stickerId int64, lang string) (*stickerLookup, error) {
+	info, err := findStickerInfo(stickerId)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := findMeta(info.Repo, int(info.PackageId))
+	if err != nil {
+		return nil, err
+	}
+	if lang != "" {
+		meta, err = localizeMeta(meta, lang)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &stickerLookup{stickerInfo: *info, Meta: json.RawMessage(meta)}, nil
+}
+
+// findStickerLookup answers /sticker-info and /lookup, reporting a bad
+// request or a missing sticker with fail.
+func findStickerLookup(w http.ResponseWriter, r *http.Request, fail errorWriter) (*stickerLookup, bool) {
+	stickerId, err := strconv.ParseInt(r.FormValue("sticker"), 10, 64)
+	if err != nil {
+		fail(w, "parameter sticker must be an integer", http.StatusBadRequest)
+		return nil, false
+	}
+
+	result, err := lookupSticker(stickerId, r.FormValue("lang"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			fail(w, "no such sticker", http.StatusNotFound)
+		} else {
+			logger.Println(err)
+			fail(w, "internal server error", http.StatusInternalServerError)
+		}
+		return nil, false
+	}
+	return result, true
+}
+
+func stickerLookupHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	result, ok := findStickerLookup(w, r, http.Error)
+	if !ok {
+		return
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		logger.Println(err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func apiStickerLookupHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if !checkAPIMethod(w, r, "GET", "HEAD") {
+		return
+	}
+
+	result, ok := findStickerLookup(w, r, writeAPIError)
+	if !ok {
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, apiResponse{Data: result})
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	SUGGEST_DEFAULT_LIMIT = 10
+	SUGGEST_MAX_LIMIT     = 50
+	// SUGGEST_CANDIDATES is how many matching packages completions are
+	// collected from.
+	SUGGEST_CANDIDATES = 200
+)
+
+type suggestions struct {
+	Titles  []string `json:"titles"`
+	Authors []string `json:"authors"`
+}
+
+type suggestParams struct {
+	repos  []string
+	prefix string
+	limit  int
+}
+
+func parseSuggestParams(r *http.Request) (suggestParams, error) {
+	var params suggestParams
+	var err error
+	params.repos, err = parseRepos(r)
+	if err != nil {
+		return params, err
+	}
+
+	params.prefix = r.FormValue("prefix")
+	if strings.TrimSpace(params.prefix) == "" {
+		return params, errors.New("parameter prefix is required")
+	}
+
+	params.limit = SUGGEST_DEFAULT_LIMIT
+	if r.FormValue("limit") != "" {
+		params.limit, err = strconv.Atoi(r.FormValue("limit"))
+		if err != nil || params.limit < 1 || params.limit > SUGGEST_MAX_LIMIT {
+			return params, errors.New("parameter limit must be an integer from 1 to " + strconv.Itoa(SUGGEST_MAX_LIMIT))
+		}
+	}
+	return params, nil
+}
+
+func suggestHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	params, err := parseSuggestParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := suggest(params)
+	if err != nil {
+		logger.Println(err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		logger.Println(err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func apiSuggestHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if !checkAPIMethod(w, r, "GET", "HEAD") {
+		return
+	}
+
+	params, err := parseSuggestParams(r)
+	if err != nil {
+		writeAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := suggest(params)
+	if err != nil {
+		logger.Println(err)
+		writeAPIError(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, apiResponse{Data: result})
+}
+
+// suggest finds packages whose title or author has a term starting with
+// the prefix, then completes the prefix with the titles and authors of
+// those packages, most frequent first.
+func suggest(params suggestParams) (*suggestions, error) {
+	match := prefixQueryText(params.prefix)
+	if match == "" {
+		return &suggestions{Titles: []string{}, Authors: []string{}}, nil
+	}
+
+	prefix := normalizeText(params.prefix)
+	titles := make(map[string]int)
+	authors := make(map[string]int)
+	for _, repo := range params.repos {
+		repo_fts := repo + "_fts"
+		pkgRows, err := stickerDB.Query("SELECT "+repo+".meta "+
+			"FROM "+repo+","+repo_fts+
+			" WHERE "+repo_fts+" MATCH ? AND "+repo+".packageId="+repo_fts+".packageId AND "+repo+".hidden=0 "+
+			"ORDER BY "+repo+".date DESC LIMIT ?",
+			match, SUGGEST_CANDIDATES)
+		if err != nil {
+			return nil, err
+		}
+
+		for pkgRows.Next() {
+			var metaText string
+			err = pkgRows.Scan(&metaText)
+			if err != nil {
+				pkgRows.Close()
+				return nil, err
+			}
+
+			var meta Meta
+			err = json.Unmarshal([]byte(metaText), &meta)
+			if err != nil {
+				logger.Println(err)
+				continue
+			}
+			collectCompletions(titles, meta.Title, prefix)
+			collectCompletions(authors, meta.Author, prefix)
+		}
+		err = pkgRows.Err()
+		pkgRows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &suggestions{
+		Titles:  topCompletions(titles, prefix, params.limit),
+		Authors: topCompletions(authors, prefix, params.limit),
+	}, nil
+}
+
+// prefixQueryText is the query of the prefix with its last term open
+// ended, since the user has not finished typing it.
+func prefixQueryText(prefix string) string {
+	tokens := tokenize(prefix)
+	if len(tokens) == 0 {
+		return ""
+	}
+
+	terms := make([]string, 0, len(tokens))
+	for _, token := range tokens[:len(tokens)-1] {
+		terms = append(terms, tokenQueryTerms(token, "")...)
+	}
+
+	last := tokens[len(tokens)-1]
+	if last.kind == WORD_TOKEN {
+		// a half typed word is not stemmed, its stem may be shorter than
+		// what has been typed, so only its leading trigram is matched
+		runes := []rune(stripDiacritics(last.text()))
+		if len(runes) < 3 {
+			terms = append(terms, string(runes)+"*")
+		} else {
+			terms = append(terms, string(runes[:3]))
+		}
+		return strings.Join(terms, " ")
+	}
+
+	lastTerms := tokenQueryTerms(last, "")
+	lastTerm := lastTerms[len(lastTerms)-1]
+	switch {
+	case strings.HasSuffix(lastTerm, "*"):
+	case strings.HasSuffix(lastTerm, `"`):
+		lastTerm = strings.TrimSuffix(lastTerm, `"`) + `*"`
+	default:
+		lastTerm += "*"
+	}
+	lastTerms[len(lastTerms)-1] = lastTerm
+	return strings.Join(append(terms, lastTerms...), " ")
+}
+
+// normalizeText applies the normalization of the tokenizer so that the
+// prefix can be compared with titles and authors.
+func normalizeText(text string) string {
+	return strings.TrimSpace(stripDiacritics(caseFolder.String(norm.NFKC.String(text))))
+}
+
+func collectCompletions(completions map[string]int, names map[string]string, prefix string) {
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		if hasWordPrefix(normalizeText(name), prefix) {
+			completions[name]++
+		}
+	}
+}
+
+// hasWordPrefix reports whether a word of text starts with prefix. CJK and
+// Thai have no word boundary, so they may match anywhere.
+func hasWordPrefix(text, prefix string) bool {
+	for offset := 0; offset <= len(text)-len(prefix); {
+		i := strings.Index(text[offset:], prefix)
+		if i < 0 {
+			return false
+		}
+		i += offset
+
+		before, _ := utf8.DecodeLastRuneInString(text[:i])
+		first, _ := utf8.DecodeRuneInString(prefix)
+		if i == 0 || !(unicode.IsLetter(before) || unicode.IsDigit(before)) ||
+			isCJK(first) || unicode.Is(unicode.Thai, first) {
+			return true
+		}
+		_, size := utf8.DecodeRuneInString(text[i:])
+		offset = i + size
+	}
+	return false
+}
+
+// topCompletions puts names starting with the prefix first, then the most
+// frequent and the shortest.
+func topCompletions(completions map[string]int, prefix string, limit int) []string {
+	names := make([]string, 0, len(completions))
+	starts := make(map[string]bool, len(completions))
+	for name := range completions {
+		names = append(names, name)
+		starts[name] = strings.HasPrefix(normalizeText(name), prefix)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		a, b := names[i], names[j]
+		if starts[a] != starts[b] {
+			return starts[a]
+		}
+		if completions[a] != completions[b] {
+			return completions[a] > completions[b]
+		}
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		return a < b
+	})
+
+	if len(names) > limit {
+		names = names[:limit]
+	}
+	return names
+}
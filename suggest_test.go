@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPrefixQueryText(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"b", "b*"},
+		{"br", "br*"},
+		{"bro", "bro"},
+		{"brownie", "bro"},
+		{"Bröwn", "bro"},
+		{"brown c", "bro row own c*"},
+		{"cat bro", "cat bro"},
+		{"東", "東*"},
+		{"東京", `"東京*"`},
+		{"cat 20", "cat 20*"},
+		{" !? ", ""},
+	}
+
+	for _, test := range tests {
+		if got := prefixQueryText(test.prefix); got != test.want {
+			t.Errorf("prefixQueryText(%q) = %q, want %q", test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestHasWordPrefix(t *testing.T) {
+	tests := []struct {
+		text   string
+		prefix string
+		want   bool
+	}{
+		{"brown and cony", "co", true},
+		{"brown and cony", "brown", true},
+		{"bacon", "co", false},
+		{"bacon cola", "co", true},
+		{"cony", "cony and", false},
+		{"ブラウン", "ラウ", true},
+	}
+
+	for _, test := range tests {
+		if got := hasWordPrefix(test.text, test.prefix); got != test.want {
+			t.Errorf("hasWordPrefix(%q, %q) = %v, want %v", test.text, test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestCollectCompletions(t *testing.T) {
+	completions := make(map[string]int)
+	collectCompletions(completions, map[string]string{
+		"en": "Brown ",
+		"ja": "Brown",
+		"ko": " ",
+		"th": "Cony",
+	}, "bro")
+	collectCompletions(completions, map[string]string{"en": "Brown"}, "bro")
+
+	want := map[string]int{"Brown": 2}
+	if !reflect.DeepEqual(completions, want) {
+		t.Errorf("collectCompletions = %v, want %v", completions, want)
+	}
+}
+
+func TestTopCompletions(t *testing.T) {
+	completions := map[string]int{
+		"Cony and Brown": 5,
+		"Brownie":        1,
+		"Brown Farm":     2,
+		"Brown":          2,
+	}
+
+	got := topCompletions(completions, "brown", 3)
+	want := []string{"Brown", "Brown Farm", "Brownie"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("topCompletions = %q, want %q", got, want)
+	}
+
+	got = topCompletions(completions, "brown", SUGGEST_MAX_LIMIT)
+	if len(got) != len(completions) || got[len(got)-1] != "Cony and Brown" {
+		t.Errorf("topCompletions = %q, want the names not starting with the prefix last", got)
+	}
+}
@@ -1,58 +1,296 @@
 package main
 
 import (
-	"bufio"
 	"strings"
 	"unicode"
 
 	"github.com/carylorrk/go-porterstemmer"
+	"github.com/kljensen/snowball"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
 )
 
-func transformQueryText(query string) string {
-	letter := make([]string, 0, len(query))
-	alpha := make([]rune, 0, len(query))
-	num := make([]rune, 0, len(query))
-	for _, char := range query {
-		letter = append(letter, " ")
-		alpha = append(alpha, ' ')
-		num = append(num, ' ')
+type tokenKind int
+
+const (
+	WORD_TOKEN tokenKind = iota
+	NUMBER_TOKEN
+	// runs of CJK or Thai, which are written without spaces between words
+	RUN_TOKEN
+	EMOJI_TOKEN
+)
+
+// token is a piece of text of one kind. Its units are characters together
+// with their combining marks.
+type token struct {
+	kind  tokenKind
+	units []string
+}
+
+// snowballLanguages maps the languages snowball can stem to its names.
+// English keeps the porter stemmer the index has always used.
+var snowballLanguages = map[string]string{
+	"es": "spanish",
+	"fr": "french",
+	"ru": "russian",
+	"sv": "swedish",
+	"nb": "norwegian",
+	"no": "norwegian",
+	"hu": "hungarian",
+}
+
+var caseFolder = cases.Fold()
+
+// transformIndexText turns a title or author into the terms stored in the
+// _fts tables: trigrams of stemmed words, bigrams of CJK and Thai runs,
+// emoji and numbers. lang picks the stemmer, empty for the default.
+func transformIndexText(text, lang string) string {
+	tokens := tokenize(text)
+	result := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		switch token.kind {
+		case WORD_TOKEN:
+			result = append(result, wordTrigrams(token.text(), lang))
+		case RUN_TOKEN:
+			result = append(result, strings.Join(runBigrams(token.units, true), " "))
+		default:
+			result = append(result, token.text())
+		}
+	}
+	return strings.Join(result, " ")
+}
+
+// queryTerms returns the FTS terms that must all match for text. A CJK or
+// Thai run must match as a contiguous sequence, so it becomes a phrase of
+// its bigrams.
+func queryTerms(text, lang string) []string {
+	tokens := tokenize(text)
+	result := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		result = append(result, tokenQueryTerms(token, lang)...)
+	}
+	return result
+}
+
+func tokenQueryTerms(token token, lang string) []string {
+	switch {
+	case token.kind == WORD_TOKEN:
+		return strings.Fields(wordTrigrams(token.text(), lang))
+	case token.kind == RUN_TOKEN && len(token.units) == 1:
+		// a single character is the start of a bigram or the last
+		// character of a run
+		return []string{token.text() + "*"}
+	case token.kind == RUN_TOKEN:
+		return []string{`"` + strings.Join(runBigrams(token.units, false), " ") + `"`}
+	}
+	return []string{token.text()}
+}
+
+// phraseQueryText returns an FTS phrase matching the terms of text in the
+// same order as transformIndexText stores them, or an empty string when
+// text has no term. The last run may end in the middle of an indexed run,
+// so it has no trailing unigram.
+func phraseQueryText(text, lang string) string {
+	tokens := tokenize(text)
+	result := make([]string, 0, len(tokens))
+	for i, token := range tokens {
+		switch {
+		case token.kind == WORD_TOKEN:
+			result = append(result, wordTrigrams(token.text(), lang))
+		case token.kind == RUN_TOKEN && i == len(tokens)-1 && len(token.units) == 1:
+			result = append(result, token.text()+"*")
+		case token.kind == RUN_TOKEN:
+			result = append(result, strings.Join(runBigrams(token.units, i != len(tokens)-1), " "))
+		default:
+			result = append(result, token.text())
+		}
+	}
+	if len(result) == 0 {
+		return ""
+	}
+	return `"` + strings.Join(result, " ") + `"`
+}
+
+// fuzzyQueryText matches any of the terms of the query, so that a package
+// missing some trigrams because of a typo is still a candidate.
+func fuzzyQueryText(query, lang string) string {
+	tokens := tokenize(query)
+	seen := make(map[string]bool)
+	terms := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		var parts []string
+		switch {
+		case token.kind == WORD_TOKEN:
+			parts = strings.Fields(wordTrigrams(token.text(), lang))
+		case token.kind == RUN_TOKEN && len(token.units) == 1:
+			parts = []string{token.text() + "*"}
+		case token.kind == RUN_TOKEN:
+			parts = runBigrams(token.units, false)
+		default:
+			parts = []string{token.text()}
+		}
+
+		for _, part := range parts {
+			if !seen[part] {
+				seen[part] = true
+				terms = append(terms, part)
+			}
+		}
+	}
+	return strings.Join(terms, " OR ")
+}
+
+// wordTrigrams returns the trigrams of a word. Accents are stripped before
+// stemming so that a word gets the same terms with or without them.
+func wordTrigrams(word, lang string) string {
+	return toTrigram(stem(stripDiacritics(word), lang))
+}
+
+func (self *token) text() string {
+	return strings.Join(self.units, "")
+}
+
+// tokenize normalizes text with NFKC and case folding, then splits it by
+// script: letters of alphabets into words, CJK and Thai into runs, digits
+// into numbers and each emoji on its own.
+func tokenize(text string) []token {
+	text = caseFolder.String(norm.NFKC.String(text))
+
+	tokens := make([]token, 0)
+	var current *token
+	joinNext := false
+	for _, char := range text {
+		if joinNext {
+			// the next part of a zero width joiner sequence
+			current.units[len(current.units)-1] += string(char)
+			joinNext = false
+			continue
+		}
+
+		if isCombining(char) {
+			if current != nil {
+				current.units[len(current.units)-1] += string(char)
+				joinNext = char == 0x200D && current.kind == EMOJI_TOKEN
+			}
+			continue
+		}
+
+		var kind tokenKind
 		switch {
-		case isAlpha(char):
-			alpha[len(alpha)-1] = char
+		case (isCJK(char) || unicode.Is(unicode.Thai, char)) && !unicode.IsPunct(char) && !unicode.IsSpace(char):
+			kind = RUN_TOKEN
+		case unicode.IsLetter(char):
+			kind = WORD_TOKEN
 		case unicode.IsDigit(char):
-			num[len(num)-1] = char
-		case isCJK(char):
-			letter[len(letter)-1] = string(char)
+			kind = NUMBER_TOKEN
+		case isEmoji(char):
+			kind = EMOJI_TOKEN
+		default:
+			current = nil
+			continue
+		}
+
+		if current == nil || current.kind != kind || kind == EMOJI_TOKEN {
+			tokens = append(tokens, token{kind: kind})
+			current = &tokens[len(tokens)-1]
 		}
+		current.units = append(current.units, string(char))
 	}
+	return tokens
+}
 
-	scanner := bufio.NewScanner(strings.NewReader(string(alpha)))
-	scanner.Split(bufio.ScanWords)
-	result := make([]string, 0, len(query)*3)
-	for scanner.Scan() {
-		porter := porterstemmer.StemString(scanner.Text())
-		result = append(result, toTrigram(porter))
+// isCombining reports whether char belongs to the character before it:
+// combining marks, the emoji variation selector, the zero width joiner and
+// skin tone modifiers.
+func isCombining(char rune) bool {
+	return unicode.In(char, unicode.Mn, unicode.Mc, unicode.Me) ||
+		char == 0xFE0F || char == 0x200D ||
+		(char >= 0x1F3FB && char <= 0x1F3FF)
+}
+
+// stem uses the stemmer of lang. Without a language, ASCII words get the
+// porter stemmer like they always had and the others are left alone.
+func stem(word, lang string) string {
+	base := strings.ToLower(baseLanguage(lang))
+	if language, ok := snowballLanguages[base]; ok {
+		stemmed, err := snowball.Stem(word, language, true)
+		if err != nil {
+			return word
+		}
+		return stemmed
 	}
-	result = append(result, letter...)
-	result = append(result, string(num))
-	return strings.Join(result, " ")
+
+	if (base == "" || base == "en") && isASCII(word) {
+		return porterstemmer.StemString(word)
+	}
+	return word
+}
+
+// stripDiacritics removes the accents on Latin, Greek and Cyrillic letters.
+// Marks on other scripts, such as Thai vowels, are part of the letter.
+func stripDiacritics(word string) string {
+	decomposed := norm.NFD.String(word)
+	result := make([]rune, 0, len(decomposed))
+	var base rune
+	for _, char := range decomposed {
+		if unicode.Is(unicode.Mn, char) {
+			if unicode.In(base, unicode.Latin, unicode.Greek, unicode.Cyrillic) {
+				continue
+			}
+		} else {
+			base = char
+		}
+		result = append(result, char)
+	}
+	return norm.NFC.String(string(result))
+}
+
+// runBigrams splits a run of characters into overlapping bigrams. For the
+// index the last character is kept as a unigram too, so a single character
+// query finds it with a prefix match.
+func runBigrams(units []string, withLast bool) []string {
+	if len(units) == 1 {
+		return []string{units[0]}
+	}
+
+	bigrams := make([]string, 0, len(units))
+	for i := 1; i < len(units); i++ {
+		bigrams = append(bigrams, units[i-1]+units[i])
+	}
+	if withLast {
+		bigrams = append(bigrams, units[len(units)-1])
+	}
+	return bigrams
 }
 
 func toTrigram(text string) string {
-	if len(text) < 4 {
+	runes := []rune(text)
+	if len(runes) < 4 {
 		return text
 	}
 
-	trigrams := make([]string, 0, len(text))
-	for i := 2; i < len(text); i++ {
-		trigrams = append(trigrams, text[i-2:i+1])
+	trigrams := make([]string, 0, len(runes))
+	for i := 2; i < len(runes); i++ {
+		trigrams = append(trigrams, string(runes[i-2:i+1]))
 	}
 	return strings.Join(trigrams, " ")
 }
 
-func isAlpha(char rune) bool {
-	return (char >= 'a' && char <= 'z') ||
-		(char >= 'A' && char <= 'Z')
+func isASCII(text string) bool {
+	for _, char := range text {
+		if char > unicode.MaxASCII {
+			return false
+		}
+	}
+	return true
+}
+
+func isEmoji(char rune) bool {
+	return unicode.Is(unicode.So, char) ||
+		// Mahjong tiles to Symbols and Pictographs Extended-A
+		(char >= 0x1F000 && char <= 0x1FAFF) ||
+		// Miscellaneous Symbols and Dingbats
+		(char >= 0x2600 && char <= 0x27BF)
 }
 
 func isCJK(char rune) bool {
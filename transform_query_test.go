@@ -0,0 +1,158 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	type want struct {
+		kind tokenKind
+		text string
+	}
+	tests := []struct {
+		text string
+		want []want
+	}{
+		{"Café 東京タワー 2024", []want{
+			{WORD_TOKEN, "café"},
+			{RUN_TOKEN, "東京タワー"},
+			{NUMBER_TOKEN, "2024"},
+		}},
+		{"ＡＢＣ-def", []want{
+			{WORD_TOKEN, "abc"},
+			{WORD_TOKEN, "def"},
+		}},
+		{"brown2cony", []want{
+			{WORD_TOKEN, "brown"},
+			{NUMBER_TOKEN, "2"},
+			{WORD_TOKEN, "cony"},
+		}},
+		{"😀👍🏽👨‍👩‍👧!", []want{
+			{EMOJI_TOKEN, "😀"},
+			{EMOJI_TOKEN, "👍🏽"},
+			{EMOJI_TOKEN, "👨‍👩‍👧"},
+		}},
+		{"東京、大阪", []want{
+			{RUN_TOKEN, "東京"},
+			{RUN_TOKEN, "大阪"},
+		}},
+		{"สวัสดี", []want{
+			{RUN_TOKEN, "สวัสดี"},
+		}},
+		{" !? ", []want{}},
+	}
+
+	for _, test := range tests {
+		got := make([]want, 0)
+		for _, token := range tokenize(test.text) {
+			got = append(got, want{token.kind, token.text()})
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("tokenize(%q) = %v, want %v", test.text, got, test.want)
+		}
+	}
+}
+
+func TestTokenizeUnits(t *testing.T) {
+	tokens := tokenize("นี่")
+	if len(tokens) != 1 || !reflect.DeepEqual(tokens[0].units, []string{"นี่"}) {
+		t.Errorf("tokenize keeps the marks with their letter, got %+v", tokens)
+	}
+}
+
+func TestStripDiacritics(t *testing.T) {
+	tests := []struct {
+		word string
+		want string
+	}{
+		{"crème brûlée", "creme brulee"},
+		{"ñandú", "nandu"},
+		{"ёлка", "елка"},
+		{"άλφα", "αλφα"},
+		{"ที่", "ที่"},
+		{"plain", "plain"},
+	}
+
+	for _, test := range tests {
+		if got := stripDiacritics(test.word); got != test.want {
+			t.Errorf("stripDiacritics(%q) = %q, want %q", test.word, got, test.want)
+		}
+	}
+}
+
+func TestTransformIndexText(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"cat", "cat"},
+		{"Brown", "bro row own"},
+		{"東京タワー", "東京 京タ タワ ワー ー"},
+		{"東", "東"},
+		{"😀 2024", "😀 2024"},
+	}
+
+	for _, test := range tests {
+		if got := transformIndexText(test.text, ""); got != test.want {
+			t.Errorf("transformIndexText(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestTransformIndexTextAccents(t *testing.T) {
+	tests := []struct {
+		text    string
+		without string
+		lang    string
+	}{
+		{"Ñandú", "nandu", ""},
+		{"Crème Brûlée", "creme brulee", "fr"},
+		{"Ёлка", "елка", "ru"},
+	}
+
+	for _, test := range tests {
+		got := transformIndexText(test.text, test.lang)
+		want := transformIndexText(test.without, test.lang)
+		if got != want {
+			t.Errorf("transformIndexText(%q, %q) = %q, want %q as for %q",
+				test.text, test.lang, got, want, test.without)
+		}
+	}
+}
+
+func TestQueryTerms(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"Brown 2", []string{"bro", "row", "own", "2"}},
+		{"東京タ", []string{`"東京 京タ"`}},
+		{"東", []string{"東*"}},
+		{"😀", []string{"😀"}},
+	}
+
+	for _, test := range tests {
+		if got := queryTerms(test.text, ""); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("queryTerms(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestPhraseQueryText(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"brown cat", `"bro row own cat"`},
+		{"東京 タワー", `"東京 京 タワ ワー"`},
+		{"cat 東", `"cat 東*"`},
+		{"!?", ""},
+	}
+
+	for _, test := range tests {
+		if got := phraseQueryText(test.text, ""); got != test.want {
+			t.Errorf("phraseQueryText(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
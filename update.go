@@ -12,7 +12,6 @@ import (
 	"image/png"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"path"
 	"regexp"
@@ -22,110 +21,169 @@ import (
 	"time"
 )
 
-const (
-	LINE_URL   string = "http://dl.stickershop.line.naver.jp/products/0/0/1"
-	ZIP_FORMAT string = LINE_URL + "/%s/android/stickers.zip"
-	//ZIP_FORMAT       string = "http://line.polppolservice.com/getpng/stickers/sticker%s.zip"
-	META_FORMAT      string = LINE_URL + "/%s/android/productInfo.meta"
-	TAB_ON_FORMAT    string = LINE_URL + "/%s/android/tab_on.png"
-	TAB_OFF_FORMAT   string = LINE_URL + "/%s/android/tab_off.png"
-	STICKER_FORMAT   string = LINE_URL + "/%s/android/stickers/%s.png"
-	THUMBNAIL_FORMAT string = LINE_URL + "/%s/android/stickers/%s_key.png"
-)
-
 var (
-	ids  chan int
-	wait sync.WaitGroup
+	ids      chan int
+	wait     sync.WaitGroup
+	progress *crawlProgress
+
+	stickerRegexp   = regexp.MustCompile(`^[^/]+\.png$`)
+	animationRegexp = regexp.MustCompile(`^animation/([^/@]+)(@2x)?\.png$`)
+	soundRegexp     = regexp.MustCompile(`^sound/([^/]+)\.m4a$`)
 )
 
-func Update(begin, end int) {
+// updateOptions are the flags of the update command.
+type updateOptions struct {
+	// refresh re-fetches the meta of packages already in the database
+	refresh bool
+	// olderThan limits refresh to packages not checked for this long
+	olderThan time.Duration
+	workers   int
+	// rps limits the requests per second to the upstream, 0 is unlimited
+	rps           float64
+	retries       int
+	retryStatuses []int
+	// recheck is how long ids not found are skipped, 0 checks them again
+	recheck time.Duration
+	// restart ignores the checkpoint of an interrupted update
+	restart bool
+}
+
+func Update(begin, end int, options updateOptions) {
 	logger.Println("update", begin, end)
 	setupTable()
+	configureSource(options)
+
+	var err error
+	progress, err = loadCrawlProgress(begin, end, options.restart)
+	if err != nil {
+		logger.Println("load crawl state err:", err)
+		return
+	}
+	if progress.next > begin {
+		logger.Println("resume update", begin, end, "from", progress.next)
+	}
 
 	//setup worker
 	ids = make(chan int)
-	for i := 0; i < 10; i++ {
-		go worker()
+	for i := 0; i < options.workers; i++ {
+		go worker(options)
 	}
 
 	//assign job to worker
-	for id := begin; id < end; id++ {
+	for id := progress.next; id < end; id++ {
 		wait.Add(1)
 		ids <- id
 	}
 	wait.Wait()
+
+	err = progress.finish()
+	if err != nil {
+		logger.Println("clear crawl state err:", err)
+	}
 }
 
-func worker() {
+func worker(options updateOptions) {
 	for id := range ids {
 		func(id int) {
 			defer wait.Done()
+			defer progress.complete(id)
 
-			var packageId int
+			var checkedAt int64
 			repo := checkRepo(id)
 			// check exist in database
 			stickerDBLock.Lock()
-			err := stickerDB.QueryRow("SELECT packageId FROM "+repo+" WHERE packageId=?", id).Scan(&packageId)
+			err := stickerDB.QueryRow("SELECT checkedAt FROM "+repo+" WHERE packageId=?", id).Scan(&checkedAt)
 			stickerDBLock.Unlock()
 
 			switch {
 			case err == sql.ErrNoRows:
-				downlodAndInsert(id)
+				if reason, err := skipReason(id, options.recheck); err != nil {
+					logger.Println("query crawl state", id, "err:", err)
+				} else if reason != "" {
+					fmt.Println("skip", id, reason)
+					return
+				}
+
+				err = downlodAndInsert(id)
+				switch {
+				case err == ErrNotFound:
+					fmt.Println(id, " does not exist")
+				case err != nil:
+					logger.Println("update", id, "err:", err)
+				}
+				err = recordCrawl(id, err)
+				if err != nil {
+					logger.Println("record crawl state", id, "err:", err)
+				}
 			case err != nil:
 				logger.Println("query package", id, "err:", err)
-			default:
+			case !options.refresh:
 				fmt.Println("skip", id)
+			case time.Since(time.Unix(checkedAt, 0)) < options.olderThan:
+				fmt.Println("skip", id, "checked recently")
+			default:
+				refreshPackage(id)
 			}
 		}(id)
 	}
 }
 
-func download(id int) (*http.Response, error) {
-	res, err := http.Get(fmt.Sprintf(ZIP_FORMAT, strconv.Itoa(id)))
-	if err != nil {
-		var retry int
-		for retry < 5 && err != nil {
-			retry++
-			time.Sleep(1 * time.Second)
-			res, err = http.Get(fmt.Sprintf(ZIP_FORMAT, strconv.Itoa(id)))
-		}
+// configureSource applies the rate limit and retry policy to the LINE
+// source, a local mirror needs neither.
+func configureSource(options updateOptions) {
+	source, ok := stickerSource.(*LineSource)
+	if !ok {
+		return
+	}
+	source.Limiter = newRateLimiter(options.rps)
+	source.Retry = newRetryPolicy(options.retries, options.retryStatuses)
+}
+
+// parseAge parses a duration that may also be given in days, e.g. 30d.
+func parseAge(text string) (time.Duration, error) {
+	if strings.HasSuffix(text, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(text, "d"))
 		if err != nil {
-			logger.Println("http.Get err:", err)
-			return nil, err
+			return 0, err
 		}
+		return time.Duration(days) * 24 * time.Hour, nil
 	}
-	return res, err
+	return time.ParseDuration(text)
 }
 
 type OriginalMeta struct {
-	PackageId int64              `json:"packageId"`
-	Title     map[string]string  `json:"title"`
-	Author    map[string]string  `json:"author"`
-	Stickers  []map[string]int64 `json:"stickers"`
+	PackageId    int64              `json:"packageId"`
+	Title        map[string]string  `json:"title"`
+	Author       map[string]string  `json:"author"`
+	Stickers     []map[string]int64 `json:"stickers"`
+	HasAnimation bool               `json:"hasAnimation"`
+	HasSound     bool               `json:"hasSound"`
 }
 
 type Meta struct {
-	PackageId int64             `json:"packageId"`
-	Title     map[string]string `json:"title"`
-	Author    map[string]string `json:"author"`
-	Stickers  []int64           `json:"stickers"`
+	PackageId    int64             `json:"packageId"`
+	Title        map[string]string `json:"title"`
+	Author       map[string]string `json:"author"`
+	Stickers     []int64           `json:"stickers"`
+	HasAnimation bool              `json:"hasAnimation"`
+	HasSound     bool              `json:"hasSound"`
 }
 
-func unzip(id int, res *http.Response) error {
+func unzip(id int, archive io.Reader) error {
 	tempZipFile, err := ioutil.TempFile("", "freeliner-sticker")
 	if err != nil {
 		return err
 	}
 
-	_, err = io.Copy(tempZipFile, res.Body)
+	_, err = io.Copy(tempZipFile, archive)
 	if err != nil {
-		return err
+		return failAt(STAGE_FETCH, err)
 	}
 	defer tempZipFile.Close()
 
 	zipReader, err := zip.OpenReader(tempZipFile.Name())
 	if err != nil {
-		return err
+		return failAt(STAGE_UNZIP, err)
 	}
 	defer zipReader.Close()
 
@@ -135,42 +193,173 @@ func unzip(id int, res *http.Response) error {
 		return err
 	}
 
-	r, err := regexp.Compile(".*\\.png")
-	if err != nil {
-		return err
+	// animations are served in one resolution, the 1x one, and the @2x
+	// one only stands in for it when the archive has no 1x
+	animations := make(map[string]bool)
+	for _, f := range zipReader.File {
+		if match := animationRegexp.FindStringSubmatch(f.Name); match != nil && match[2] == "" {
+			animations[match[1]] = true
+		}
 	}
 
 	for _, f := range zipReader.File {
 		content, err := f.Open()
 		if err != nil {
-			return err
+			return failAt(STAGE_UNZIP, err)
 		}
 		defer content.Close()
 
-		var rc io.Reader
-		var filePath string
-		if r.MatchString(f.Name) {
-			rc, err = pngFileToJpeg(content)
-			filePath = path.Join(packageDirectory, strings.Replace(f.Name, "png", "jpg", -1))
-		} else {
+		switch {
+		case strings.HasSuffix(f.Name, "/"):
+			// directory entry
+		case animationRegexp.MatchString(f.Name):
+			match := animationRegexp.FindStringSubmatch(f.Name)
+			name := match[1]
+			if match[2] != "" && animations[name] {
+				break
+			}
+			err = saveFile(path.Join(packageDirectory, ANIMATION_DIRECTORY, name+PNG_EXTENSION), content)
+		case soundRegexp.MatchString(f.Name):
+			name := soundRegexp.FindStringSubmatch(f.Name)[1]
+			err = saveFile(path.Join(packageDirectory, SOUND_DIRECTORY, name+SOUND_EXTENSION), content)
+		case stickerRegexp.MatchString(f.Name):
+			err = saveSticker(packageDirectory, strings.TrimSuffix(f.Name, ".png"), content)
+		case f.Name == "productInfo.meta":
+			var rc io.Reader
 			rc, err = changeMeta(content)
-			filePath = path.Join(packageDirectory, f.Name)
+			if err == nil {
+				err = saveFile(path.Join(packageDirectory, f.Name), rc)
+			}
+		default:
+			logger.Println("skip", f.Name, "of package", id)
 		}
 		if err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		file, err := os.Create(filePath)
-		defer file.Close()
-		if err != nil {
-			return err
+// fetchEach assembles the same package directory as unzip from
+// productInfo.meta and the individual sticker, key and tab images.
+func fetchEach(id int) error {
+	metaContent, err := stickerSource.FetchMeta(id)
+	if err != nil {
+		return failAt(STAGE_FETCH, err)
+	}
+	defer metaContent.Close()
+
+	fmt.Println("process package", id, "without stickers.zip")
+	rc, err := changeMeta(metaContent)
+	if err != nil {
+		return err
+	}
+
+	metaData, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+
+	var meta Meta
+	err = json.Unmarshal(metaData, &meta)
+	if err != nil {
+		return failAt(STAGE_META, err)
+	}
+
+	packageDirectory := path.Join(stickerDirectory, fmt.Sprint(id))
+	err = os.MkdirAll(packageDirectory, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(meta.Stickers)*2+2)
+	for _, sticker := range meta.Stickers {
+		names = append(names, fmt.Sprint(sticker), fmt.Sprint(sticker, "_key"))
+	}
+	names = append(names, "tab_on", "tab_off")
+	for _, sticker := range meta.Stickers {
+		if meta.HasAnimation {
+			names = append(names, path.Join(ANIMATION_DIRECTORY, fmt.Sprint(sticker)))
+		}
+		if meta.HasSound {
+			names = append(names, path.Join(SOUND_DIRECTORY, fmt.Sprint(sticker)))
+		}
+	}
+
+	for _, name := range names {
+		err = fetchSticker(id, packageDirectory, name)
+		if err == ErrNotFound {
+			logger.Println("package", id, "has no", name)
+			continue
 		}
-		_, err = io.Copy(file, rc)
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+
+	// productInfo.meta is written last so that an interrupted fetch
+	// does not leave a package that looks complete.
+	return ioutil.WriteFile(path.Join(packageDirectory, "productInfo.meta"), metaData, os.ModePerm)
+}
+
+func fetchSticker(id int, packageDirectory, name string) error {
+	content, err := stickerSource.FetchSticker(id, name)
+	if err != nil {
+		return failAt(STAGE_FETCH, err)
+	}
+	defer content.Close()
+
+	switch path.Dir(name) {
+	case ANIMATION_DIRECTORY:
+		return saveFile(path.Join(packageDirectory, name+PNG_EXTENSION), content)
+	case SOUND_DIRECTORY:
+		return saveFile(path.Join(packageDirectory, name+SOUND_EXTENSION), content)
+	}
+	return saveSticker(packageDirectory, name, content)
+}
+
+func saveFile(filePath string, content io.Reader) error {
+	err := os.MkdirAll(path.Dir(filePath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, content)
+	return err
+}
+
+// saveSticker keeps the original png for clients that need transparency
+// and a jpg flattened onto white for the old ones.
+func saveSticker(packageDirectory, name string, content io.Reader) error {
+	pngData, err := ioutil.ReadAll(content)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(path.Join(packageDirectory, name+PNG_EXTENSION), pngData, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	rc, err := pngFileToJpeg(bytes.NewReader(pngData))
+	if err != nil {
+		return failAt(STAGE_IMAGE, err)
+	}
+
+	file, err := os.Create(path.Join(packageDirectory, name+IMAGE_EXTENSION))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, rc)
+	return err
 }
 
 func changeMeta(origin io.Reader) (io.Reader, error) {
@@ -183,13 +372,15 @@ func changeMeta(origin io.Reader) (io.Reader, error) {
 	err = json.Unmarshal(originMetaData, &originMeta)
 	if err != nil {
 		fmt.Println(err)
-		return nil, err
+		return nil, failAt(STAGE_META, err)
 	}
 
 	var meta Meta
 	meta.PackageId = originMeta.PackageId
 	meta.Title = originMeta.Title
 	meta.Author = originMeta.Author
+	meta.HasAnimation = originMeta.HasAnimation
+	meta.HasSound = originMeta.HasSound
 	meta.Stickers = make([]int64, 0, len(originMeta.Stickers))
 	for _, sticker := range originMeta.Stickers {
 		meta.Stickers = append(meta.Stickers, sticker["id"])
@@ -201,26 +392,30 @@ func changeMeta(origin io.Reader) (io.Reader, error) {
 	return bytes.NewReader(metaData), nil
 }
 
-func downlodAndInsert(id int) {
-	res, err := download(id)
-	if err != nil {
-		logger.Println(err)
-		return
+// downlodAndInsert returns ErrNotFound when the package does not exist.
+func downlodAndInsert(id int) error {
+	archive, err := stickerSource.FetchArchive(id)
+	switch {
+	case err == ErrNotFound:
+		// some packages have no stickers.zip, fetch the files one by one
+		err = fetchEach(id)
+	case err != nil:
+		return failAt(STAGE_FETCH, err)
+	default:
+		defer archive.Close()
+		fmt.Println("process package", id)
+		err = unzip(id, archive)
 	}
-	defer res.Body.Close()
-	if res.StatusCode >= 400 {
-		fmt.Println(id, " does not exist")
-		return
+	if err != nil {
+		return err
 	}
 
-	fmt.Println("process package", id)
-	err = unzip(id, res)
+	status, err := insert(id)
 	if err != nil {
-		logger.Println(err)
-		return
+		return failAt(STAGE_INSERT, err)
 	}
-
-	insert(id)
+	fmt.Println("package", id, status)
+	return nil
 }
 
 func pngFileToJpeg(pngFile io.Reader) (io.Reader, error) {
@@ -1,5 +1,7 @@
 package main
 
+import "database/sql"
+
 func UpdateAllCount() {
 	updateRepoCount("official")
 	updateRepoCount("creator")
@@ -11,7 +13,7 @@ func updateRepoCount(repo string) {
 	defer stickerDBLock.Unlock()
 	var err error
 	var count int
-	err = stickerDB.QueryRow("SELECT COUNT(*) FROM " + repo).Scan(&count)
+	err = stickerDB.QueryRow("SELECT COUNT(*) FROM " + repo + " WHERE hidden=0").Scan(&count)
 	if err != nil {
 		logger.Println(err)
 		return
@@ -21,3 +23,10 @@ func updateRepoCount(repo string) {
 		logger.Println(err)
 	}
 }
+
+// updateRepoCountTx is updateRepoCount within a transaction that changes
+// the packages of repo.
+func updateRepoCountTx(tx *sql.Tx, repo string) error {
+	_, err := tx.Exec(`UPDATE meta SET count=(SELECT COUNT(*) FROM `+repo+` WHERE hidden=0) WHERE name=?`, repo)
+	return err
+}